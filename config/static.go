@@ -8,4 +8,46 @@ const (
 	WarningGPUTemp     = 70  // GPU温度报警
 	WarningInterval    = 10  // 同种报警的报警间隔
 
+	DefaultTaskTimeout = 60   // 默认任务等待超时（秒），可在 API 配置中通过 timeout 覆盖
+	JobRetention       = 3600 // 已结束任务的保留时间（秒），超过后从内存与任务日志中删除
+
+	WebhookMaxAttempts = 5   // 回调最大投递次数
+	WebhookBaseBackoff = 2   // 回调首次重试间隔（秒），之后指数退避
+	WebhookTimeout     = 10  // 单次回调请求超时（秒）
+	WebhookLogSize     = 500 // 回调投递日志保留条数
+
+	HistoryPollInterval = 5  // 等待中任务的对账检查间隔（秒）
+	HistoryPollGrace    = 30 // 任务超过该时长（秒）没有收到任何 WebSocket 事件时，改为轮询 /history
+
+	DefaultClientID     = "fast-comfy-api" // 未配置 comfyui.client_id 时使用的 clientId
+	DefaultNodeCapacity = 1                // 未配置 comfyui.default_capacity 时节点的容量
+
+	HealthCheckInterval    = 10 // 节点健康检查间隔（秒）
+	HealthCheckTimeout     = 5  // 单次健康检查请求超时（秒）
+	HealthFailureThreshold = 3  // 连续失败多少次后熔断
+	HealthOpenDuration     = 30 // 熔断后多久（秒）进入半开状态重新探测
+
+	TelemetryMaxAge = 30 // crystools.monitor 数据超过该时长（秒）未更新视为未知，不参与资源过滤
+
+	ObjectInfoRefreshInterval = 300 // 节点 /object_info 重新拉取间隔（秒）
+	ObjectInfoTimeout         = 30  // 拉取 /object_info 的请求超时（秒），自定义节点多时响应较大
+
+	InputFileMaxSize   = 512 // 单个上传文件读取上限（MB），超过时直接拒绝，不读入内存
+	InputImageMaxSize  = 20  // image 类型变量的文件大小上限（MB）
+	InputUploadTimeout = 60  // 上传文件到 ComfyUI 节点的请求超时（秒）
+	InputAudioMaxSize  = 50  // audio / audio_url 类型变量的文件大小上限（MB）
+	InputVideoMaxSize  = 200 // video / video_url 类型变量的文件大小上限（MB）
+	InputFetchTimeout  = 60  // 下载 URL 类型变量的超时（秒），包含读取响应体
+
+	InputAudioMaxDuration = 600 // 音频输入的时长上限（秒），无法解析时长的格式不限制
+	InputVideoMaxDuration = 300 // 视频输入的时长上限（秒），无法解析时长的格式不限制
+
+	InlineBase64MinLength = 256 // 不带 data: 前缀的值至少多长才按 base64 解码，更短的视为文件名
+
+	BatchMaxItems       = 1000 // 批量生成单次请求最多条目数
+	BatchMaxConcurrency = 16   // 批量生成最大并发数
+
+	DefaultMaxQueueSize = 100 // 每个 API 网关队列的默认长度上限，可在 API 配置中通过 max_queue_size 覆盖
+	QueueRetryAfter     = 5   // 队列已满时建议调用方重试的间隔（秒），即 Retry-After
+	QueuePollInterval   = 1   // 网关队列兜底检查节点空闲容量的间隔（秒）
 )
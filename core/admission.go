@@ -0,0 +1,413 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"farshore.ai/fast-comfy-api/config"
+	"farshore.ai/fast-comfy-api/model"
+)
+
+/*
+
+网关侧排队与准入控制
+
+请求不再直接推送到 ComfyUI，而是先进入 API 自己的优先级队列，
+只有当候选节点的在途数量（网关已提交未结束 + 已预占）低于节点容量 capacity 时才出队并 PromptCommit，
+ComfyUI 端的队列保持很短，排队顺序由网关决定：
+- priority 大的先出队，相同优先级先到先出；故障转移的任务已被接纳过，排在同优先级请求之前
+- 队列长度达到 API 配置 max_queue_size（默认 config.DefaultMaxQueueSize）时直接拒绝，返回 *OverloadError（HTTP 429 + Retry-After）
+- 节点释放容量（任务结束、预占释放、恢复健康、取消排空）时唤醒队列，另外每 config.QueuePollInterval 秒兜底检查一次
+- 没有任何可用节点（全部熔断 / 排空 / 不支持 / 已尝试过）时不排队，直接失败；
+  节点只是资源不足（GPU 温度、显存）时请求照常排队，等待资源恢复或 max_queue_wait 超时
+
+过载保护（避免一个 API 占满共享节点，饿死其他 API）：
+- max_concurrent : 本 API 同时提交到节点且未结束的任务数上限，在途与排队的请求合计达到上限时新请求直接拒绝，
+                   返回 *OverloadError；已接纳的请求在本 API 有空位前留在网关队列
+- max_queue_wait : 请求在网关队列中的最长等待时间（秒），超过时直接拒绝，返回 *OverloadError，
+                   调用方快速拿到过载错误，而不是挂起直到任务超时
+
+热重载时新的 APIRuntime 接管旧队列，排队中的请求不受影响
+*/
+
+// OverloadError API 过载，调用方应在 RetryAfter 之后重试
+type OverloadError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *OverloadError) Error() string {
+	return e.Reason
+}
+
+// QueuedPrompt 在网关队列中等待节点空闲的 prompt
+type QueuedPrompt struct {
+	prompt     map[string]model.PromptNode
+	files      map[string]InputFile // 文件类型变量，选出节点后上传
+	tried      []string             // 已尝试过的节点
+	lastErr    error                // 最近一次提交失败的原因
+	priority   int
+	seq        uint64 // 入队顺序，同优先级按 seq 从小到大出队
+	enqueuedAt time.Time
+	deadline   time.Time // 排队截止时间（max_queue_wait），为空表示不限制
+
+	finished atomic.Bool
+	done     chan struct{}
+	result   submitResult
+}
+
+// submitResult 出队提交的结果
+type submitResult struct {
+	task *PromptTask
+	err  error
+}
+
+// finish 写入结果，只有第一次调用生效
+func (q *QueuedPrompt) finish(result submitResult) bool {
+	if !q.finished.CompareAndSwap(false, true) {
+		return false
+	}
+	q.result = result
+	close(q.done)
+	return true
+}
+
+// Wait 等待出队并提交到节点，ctx 结束时取消排队
+func (q *QueuedPrompt) Wait(ctx context.Context) (*PromptTask, error) {
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		if q.Cancel() {
+			return nil, ctx.Err()
+		}
+		<-q.done
+	}
+	return q.result.task, q.result.err
+}
+
+// Cancel 取消排队，已经出队提交时返回 false
+func (q *QueuedPrompt) Cancel() bool {
+	return q.finish(submitResult{err: ErrTaskCancelled})
+}
+
+// failure 没有可用节点时的错误
+func (q *QueuedPrompt) failure() error {
+	err := q.lastErr
+	if err == nil {
+		err = fmt.Errorf("没有可用的节点")
+	}
+	if len(q.tried) > 0 {
+		return fmt.Errorf("%w (已尝试节点: %s)", err, strings.Join(q.tried, ", "))
+	}
+	return err
+}
+
+// promptQueue API 的网关队列，按 priority 从大到小、seq 从小到大排序
+type promptQueue struct {
+	mu     sync.Mutex
+	items  []*QueuedPrompt
+	seq    uint64
+	notify chan struct{} // 入队时唤醒调度协程
+}
+
+func newPromptQueue() *promptQueue {
+	return &promptQueue{notify: make(chan struct{}, 1)}
+}
+
+// nextSeq 分配入队顺序号（从 1 开始，0 留给故障转移的任务）
+func (pq *promptQueue) nextSeq() uint64 {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.seq++
+	return pq.seq
+}
+
+// push 入队，limit > 0 时队列已满返回 false
+func (pq *promptQueue) push(item *QueuedPrompt, limit int) bool {
+	pq.mu.Lock()
+	pq.items = slices.DeleteFunc(pq.items, func(q *QueuedPrompt) bool { return q.finished.Load() })
+	if limit > 0 && len(pq.items) >= limit {
+		pq.mu.Unlock()
+		return false
+	}
+	index, _ := slices.BinarySearchFunc(pq.items, item, func(a, b *QueuedPrompt) int {
+		if a.priority != b.priority {
+			return b.priority - a.priority
+		}
+		if a.seq <= b.seq {
+			return -1
+		}
+		return 1
+	})
+	pq.items = slices.Insert(pq.items, index, item)
+	pq.mu.Unlock()
+
+	select {
+	case pq.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// remove 出队
+func (pq *promptQueue) remove(item *QueuedPrompt) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.items = slices.DeleteFunc(pq.items, func(q *QueuedPrompt) bool { return q == item })
+}
+
+// snapshot 按出队顺序返回排队中的请求（清理已取消的）
+func (pq *promptQueue) snapshot() []*QueuedPrompt {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.items = slices.DeleteFunc(pq.items, func(q *QueuedPrompt) bool { return q.finished.Load() })
+	return slices.Clone(pq.items)
+}
+
+// Len 排队中的请求数量
+func (pq *promptQueue) Len() int {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	count := 0
+	for _, item := range pq.items {
+		if !item.finished.Load() {
+			count++
+		}
+	}
+	return count
+}
+
+// Enqueue 变量替换、解码 / 下载文件类型变量后进入网关队列，返回排队凭证；files 为上传的文件类型变量
+// 队列已满或本 API 已达到 max_concurrent 时返回 *OverloadError
+func (api *APIRuntime) Enqueue(vars map[string]interface{}, files map[string]InputFile, priority int) (*QueuedPrompt, error) {
+	// 在途 + 排队达到 max_concurrent 时直接拒绝，不让多余的请求在队列中无限等待
+	if max_concurrent := api.apiparser.GetMaxConcurrent(); max_concurrent > 0 && api.activeCount()+api.queue.Len() >= max_concurrent {
+		LogAPIRuntime(ColorYellow+"[Enqueue] API %s 已达到并发上限 %d，拒绝请求", api.GetName(), max_concurrent)
+		return nil, &OverloadError{
+			Reason:     fmt.Sprintf("API %s 并发已达上限 %d，请稍后重试", api.GetName(), max_concurrent),
+			RetryAfter: config.QueueRetryAfter * time.Second,
+		}
+	}
+	prompt_node, err := api.apiparser.ApplyVariables(vars)
+	if err != nil {
+		LogAPIRuntime("变量替换失败: %s", err)
+		return nil, err
+	}
+	if err := api.apiparser.CheckInputFiles(files); err != nil {
+		LogAPIRuntime("文件变量校验失败: %s", err)
+		return nil, err
+	}
+	// data URI / base64 与 URL 类型变量在入队前解码、下载，不占用节点容量
+	files, err = api.resolveInputs(vars, files)
+	if err != nil {
+		LogAPIRuntime("文件变量处理失败: %s", err)
+		return nil, err
+	}
+	if err := api.prepareMasks(vars, files); err != nil {
+		LogAPIRuntime("遮罩处理失败: %s", err)
+		return nil, err
+	}
+	queued, err := api.enqueue(prompt_node, files, nil, priority, api.queue.nextSeq(), api.apiparser.GetMaxQueueSize())
+	if err == nil && api.apiparser.GetMaxQueueWait() > 0 {
+		queued.deadline = queued.enqueuedAt.Add(api.apiparser.GetMaxQueueWait())
+	}
+	return queued, err
+}
+
+// enqueue 入队，tried 为之前已尝试过的节点，limit <= 0 表示不受队列长度限制（已被接纳过的任务）
+func (api *APIRuntime) enqueue(prompt_node map[string]model.PromptNode, files map[string]InputFile, tried []string, priority int, seq uint64, limit int) (*QueuedPrompt, error) {
+	item := &QueuedPrompt{
+		prompt:     prompt_node,
+		files:      files,
+		tried:      slices.Clone(tried),
+		priority:   priority,
+		seq:        seq,
+		enqueuedAt: time.Now(),
+		done:       make(chan struct{}),
+	}
+	if len(item.tried) >= api.apiparser.GetMaxAttempts() || len(api.routableNodes(item.tried)) == 0 {
+		LogAPIRuntime("没有可用的节点")
+		if warning := api.CapabilityWarning(); warning != "" {
+			item.lastErr = fmt.Errorf("没有可用的节点: %s", warning)
+		}
+		return nil, item.failure()
+	}
+	if !api.queue.push(item, limit) {
+		LogAPIRuntime(ColorYellow+"[Enqueue] API %s 网关队列已满(%d)，拒绝请求", api.GetName(), limit)
+		return nil, &OverloadError{
+			Reason:     fmt.Sprintf("API %s 排队请求已达上限 %d，请稍后重试", api.GetName(), limit),
+			RetryAfter: config.QueueRetryAfter * time.Second,
+		}
+	}
+	return item, nil
+}
+
+// dispatchLoop 调度协程：入队、节点释放容量或定时兜底时尝试出队
+func (api *APIRuntime) dispatchLoop(stop chan struct{}) {
+	ticker := time.NewTicker(config.QueuePollInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		// 先取通道再出队，避免出队期间释放的容量被错过
+		changed := api.registry.CapacityChanged()
+		api.dispatch()
+		select {
+		case <-stop:
+			return
+		case <-changed:
+		case <-api.queue.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch 按优先级依次为排队中的请求预占有空闲容量的节点，预占成功即出队提交
+func (api *APIRuntime) dispatch() {
+	items := api.queue.snapshot()
+	if len(items) == 0 {
+		return
+	}
+	routable := nodeURLs(api.routableNodes(nil))
+	candidates := map[string][]string{} // 模型集合 -> 候选节点，热节点不受 min_free_vram_mb 限制
+	max_concurrent := api.apiparser.GetMaxConcurrent()
+	active := api.activeCount()
+	for _, item := range items {
+		if !item.deadline.IsZero() && time.Now().After(item.deadline) {
+			api.queue.remove(item)
+			LogAPIRuntime(ColorYellow+"[Dispatch] API %s 请求排队超过 %s，拒绝", api.GetName(), api.apiparser.GetMaxQueueWait())
+			item.finish(submitResult{err: &OverloadError{
+				Reason:     fmt.Sprintf("API %s 负载过高，排队超过 %s 仍未分配到节点，请稍后重试", api.GetName(), api.apiparser.GetMaxQueueWait()),
+				RetryAfter: config.QueueRetryAfter * time.Second,
+			}})
+			continue
+		}
+		if max_concurrent > 0 && active >= max_concurrent {
+			continue // 本 API 已达到并发上限，等待任务结束
+		}
+		if len(excludeNodes(routable, item.tried)) == 0 {
+			// 排队期间节点全部不可用（熔断 / 排空）或都已尝试过
+			api.queue.remove(item)
+			item.finish(submitResult{err: item.failure()})
+			continue
+		}
+		// 资源不足的节点不参与出队，请求继续排队直到资源恢复或 max_queue_wait 超时
+		key := strings.Join(promptModels(item.prompt), "\n")
+		if _, ok := candidates[key]; !ok {
+			candidates[key] = api.candidateNodes(item.prompt, nil)
+		}
+		if len(api.freeNodes(excludeNodes(candidates[key], item.tried))) == 0 {
+			continue
+		}
+		target_server := api.GetBestServer(item.prompt, item.tried...)
+		if target_server == "" {
+			continue
+		}
+		api.queue.remove(item)
+		if item.finished.Load() {
+			api.registry.Release(target_server) // 排队期间已被取消
+			continue
+		}
+		active++
+		api.committing.Add(1)
+		go api.commit(item, target_server)
+	}
+}
+
+// activeCount 本 API 已提交到节点未结束以及正在提交的任务数
+func (api *APIRuntime) activeCount() int {
+	count := int(api.committing.Load())
+	api.waiting.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// 辅助函数：去掉 exclude 中的节点
+func excludeNodes(nodes []string, exclude []string) []string {
+	return slices.DeleteFunc(slices.Clone(nodes), func(node string) bool {
+		return slices.Contains(exclude, node)
+	})
+}
+
+// freeNodes 在途数量（含预占）低于容量的节点
+func (api *APIRuntime) freeNodes(nodes []string) []string {
+	capacity := make(map[string]int, len(api.nodes))
+	for _, node := range api.nodes {
+		capacity[node.URL] = node.Capacity
+	}
+	registry := api.registry
+	registry.reserveMu.Lock()
+	defer registry.reserveMu.Unlock()
+	in_flight := registry.InFlight()
+	free := []string{}
+	for _, node := range nodes {
+		if in_flight[node]+registry.reserved[node] < capacity[node] {
+			free = append(free, node)
+		}
+	}
+	return free
+}
+
+// commit 将出队的 prompt（以及文件类型变量）提交到已预占的节点，提交失败时按重试策略重新排队换节点（prompt 校验失败除外）
+func (api *APIRuntime) commit(item *QueuedPrompt, target_server string) {
+	item.tried = append(item.tried, target_server)
+	max_attempts := api.apiparser.GetMaxAttempts()
+
+	err := api.uploadInputs(target_server, item.prompt, item.files)
+	prompt_id := ""
+	if err == nil {
+		prompt_id, err = PromptCommit(target_server, item.prompt, api.registry.ClientID())
+	}
+	if err != nil {
+		api.committing.Add(-1)
+		api.registry.Release(target_server)
+		LogAPIRuntime(ColorYellow+"提交任务失败 node=%s (第 %d/%d 次): %s", target_server, len(item.tried), max_attempts, err)
+		item.lastErr = err
+		// prompt 校验失败（node_errors 等）换节点也不会成功，只有网络错误或节点 5xx 才换节点重试
+		var rejected *PromptRejectedError
+		if errors.As(err, &rejected) {
+			item.finish(submitResult{err: item.failure()})
+			return
+		}
+		if len(item.tried) < max_attempts && !item.finished.Load() {
+			api.queue.push(item, 0)
+			return
+		}
+		item.finish(submitResult{err: item.failure()})
+		return
+	}
+
+	// 记录节点最近运行的模型，用于模型亲和调度
+	if node, ok := api.registry.Get(target_server); ok {
+		node.markWarm(api.GetName(), promptModels(item.prompt))
+	}
+
+	// 先登记在途再释放预占，避免容量短暂空出被其他请求抢占
+	task := api.Adopt(prompt_id, target_server)
+	task.Tried = item.tried
+	task.prompt = item.prompt
+	task.files = item.files
+	task.priority = item.priority
+	api.committing.Add(-1)
+	api.registry.Release(target_server)
+
+	LogAPIRuntime("[Dispatch] prompt_id=%s 提交到 %s，排队耗时 %s", prompt_id, target_server, time.Since(item.enqueuedAt).Round(time.Millisecond))
+	if !item.finish(submitResult{task: task}) {
+		// 提交过程中调用方取消了请求
+		go api.Cancel(prompt_id)
+	}
+}
+
+// DropQueued API 被移除时，排队中的请求直接失败
+func (api *APIRuntime) DropQueued(err error) {
+	for _, item := range api.queue.snapshot() {
+		api.queue.remove(item)
+		item.finish(submitResult{err: err})
+	}
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"farshore.ai/fast-comfy-api/config"
+)
+
+// newTestRuntime 一个节点、不启动健康检查与调度协程的 APIRuntime，options 为 API 配置中的额外字段
+func newTestRuntime(t *testing.T, options string) *APIRuntime {
+	t.Helper()
+	parser, err := NewAPIParser([]byte(fmt.Sprintf(`{
+		"name": "test",
+		"prompt": {"1": {"class_type": "SaveImage", "inputs": {"filename_prefix": ""}}},
+		"variables": {"prefix": {"path": "1.inputs.filename_prefix", "type": "string", "default": "out"}}
+		%s
+	}`, options)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := &NodeRegistry{
+		byName:          make(map[string]*ComfyNode),
+		byURL:           make(map[string]*ComfyNode),
+		reserved:        make(map[string]int),
+		capacityCh:      make(chan struct{}),
+		defaultCapacity: config.DefaultNodeCapacity,
+	}
+	node := registry.add("gpu-a", "http://127.0.0.1:1", nil, 1)
+	scheduler, _ := NewScheduler(SchedulerLeastInFlight, nil)
+	return &APIRuntime{
+		apiparser: parser,
+		registry:  registry,
+		nodes:     []*ComfyNode{node},
+		scheduler: scheduler,
+		queue:     newPromptQueue(),
+	}
+}
+
+func TestEnqueueOverload(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    string
+		committing int32 // 已出队正在提交的任务数
+		drained    bool
+		accepted   int // 前几个请求应被接纳
+		overload   bool
+	}{
+		{name: "queue limit", options: `, "max_queue_size": 2`, accepted: 2, overload: true},
+		{name: "max concurrent counts queued", options: `, "max_concurrent": 3`, accepted: 3, overload: true},
+		{name: "max concurrent counts active", options: `, "max_concurrent": 2`, committing: 1, accepted: 1, overload: true},
+		{name: "max concurrent already full", options: `, "max_concurrent": 1`, committing: 1, accepted: 0, overload: true},
+		{name: "no routable node", drained: true, accepted: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestRuntime(t, tt.options)
+			api.committing.Add(tt.committing)
+			api.nodes[0].drained.Store(tt.drained)
+			for i := 0; i < tt.accepted; i++ {
+				if _, err := api.Enqueue(nil, nil, 0); err != nil {
+					t.Fatalf("Enqueue() #%d error = %v", i+1, err)
+				}
+			}
+			_, err := api.Enqueue(nil, nil, 0)
+			var overload *OverloadError
+			if errors.As(err, &overload) != tt.overload {
+				t.Fatalf("Enqueue() error = %v, want overload %v", err, tt.overload)
+			}
+			if err == nil {
+				t.Fatal("Enqueue() accepted a request over the limit")
+			}
+			if tt.overload && overload.RetryAfter != config.QueueRetryAfter*time.Second {
+				t.Fatalf("RetryAfter = %s, want %s", overload.RetryAfter, config.QueueRetryAfter*time.Second)
+			}
+			if got := api.queue.Len(); got != tt.accepted {
+				t.Fatalf("queue.Len() = %d, want %d", got, tt.accepted)
+			}
+		})
+	}
+}
+
+func TestDispatchQueueWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  string
+		expired  bool // 排队截止时间已过
+		overload bool
+	}{
+		{name: "waits while node busy", options: `, "max_queue_wait": 30`},
+		{name: "no queue wait limit", expired: true},
+		{name: "queue wait exceeded", options: `, "max_queue_wait": 30`, expired: true, overload: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestRuntime(t, tt.options)
+			// 节点已满，请求只能留在队列中
+			api.registry.reserved[api.nodes[0].URL] = 1
+			queued, err := api.Enqueue(nil, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expired {
+				queued.enqueuedAt = queued.enqueuedAt.Add(-time.Minute)
+				if !queued.deadline.IsZero() {
+					queued.deadline = queued.deadline.Add(-time.Minute)
+				}
+			}
+			api.dispatch()
+
+			select {
+			case <-queued.done:
+				var overload *OverloadError
+				if !tt.overload || !errors.As(queued.result.err, &overload) {
+					t.Fatalf("request finished with %v, want overload %v", queued.result.err, tt.overload)
+				}
+				if api.queue.Len() != 0 {
+					t.Fatalf("queue.Len() = %d, want 0", api.queue.Len())
+				}
+			default:
+				if tt.overload {
+					t.Fatal("request still queued after max_queue_wait")
+				}
+				if api.queue.Len() != 1 {
+					t.Fatalf("queue.Len() = %d, want 1", api.queue.Len())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"farshore.ai/fast-comfy-api/model"
+)
+
+/*
+
+模型亲和调度
+
+在不同工作流之间切换模型（如 FLUX 与 SD）会让节点重新加载数 GB 的模型。
+每次提交成功后记录节点最近一次运行的模型集合（*Loader* 节点中 *_name 输入的取值，如
+CheckpointLoaderSimple.ckpt_name、UNETLoader.unet_name），没有加载器节点时记录 API 名称。
+
+调度策略选出节点后，如果该节点不是"热"节点（已加载本次 prompt 的全部模型），
+而热节点的负载不超过选中节点负载 + affinity.max_queue_gap，则改选负载最低的热节点。
+负载：least_queue 策略为队列数量 + 预占数量，其他策略为网关在途数量
+*/
+
+// nodeAffinity 节点最近一次运行的模型
+type nodeAffinity struct {
+	mu        sync.Mutex
+	models    []string // 模型集合（已排序）
+	apiName   string
+	updatedAt time.Time
+}
+
+// NodeAffinity 节点最近一次运行的模型（节点状态接口中展示）
+type NodeAffinity struct {
+	Models    []string  `json:"models,omitempty"`
+	APIName   string    `json:"api_name"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// promptModels 提取 prompt 中加载器节点的模型名称（排序去重）
+func promptModels(prompt map[string]model.PromptNode) []string {
+	models := []string{}
+	for _, node := range prompt {
+		if !strings.Contains(node.ClassType, "Loader") {
+			continue
+		}
+		for key, value := range node.Inputs {
+			name, ok := value.(string)
+			if !ok || name == "" || !strings.HasSuffix(key, "_name") {
+				continue
+			}
+			models = append(models, node.ClassType+"/"+key+"="+name)
+		}
+	}
+	sort.Strings(models)
+	return slices.Compact(models)
+}
+
+// markWarm 记录节点最近一次运行的模型
+func (n *ComfyNode) markWarm(apiName string, models []string) {
+	n.affinity.mu.Lock()
+	defer n.affinity.mu.Unlock()
+	n.affinity.models = models
+	n.affinity.apiName = apiName
+	n.affinity.updatedAt = time.Now()
+}
+
+// isWarm 节点是否已加载本次 prompt 需要的全部模型（没有加载器节点时按 API 名称判断）
+func (n *ComfyNode) isWarm(apiName string, models []string) bool {
+	n.affinity.mu.Lock()
+	defer n.affinity.mu.Unlock()
+	if n.affinity.updatedAt.IsZero() {
+		return false
+	}
+	if len(models) == 0 {
+		return n.affinity.apiName == apiName
+	}
+	for _, m := range models {
+		if !slices.Contains(n.affinity.models, m) {
+			return false
+		}
+	}
+	return true
+}
+
+// lastRun 返回节点最近一次运行的模型
+func (n *ComfyNode) lastRun() (NodeAffinity, bool) {
+	n.affinity.mu.Lock()
+	defer n.affinity.mu.Unlock()
+	if n.affinity.updatedAt.IsZero() {
+		return NodeAffinity{}, false
+	}
+	return NodeAffinity{
+		Models:    slices.Clone(n.affinity.models),
+		APIName:   n.affinity.apiName,
+		UpdatedAt: n.affinity.updatedAt,
+	}, true
+}
+
+// preferWarm 调度策略选出 picked 后，按亲和配置改选负载相近的热节点
+func (api *APIRuntime) preferWarm(picked string, nodes []string, stats NodeStats, models []string) string {
+	gap := api.apiparser.GetAffinityGap()
+	if picked == "" || gap < 0 {
+		return picked
+	}
+	load := func(node string) int {
+		if stats.Queue != nil {
+			return queueLoad(stats.Queue[node], stats.Reserved[node])
+		}
+		return stats.InFlight[node]
+	}
+
+	name := api.GetName()
+	warm := ""
+	for _, node := range api.nodes {
+		if !slices.Contains(nodes, node.URL) || !node.isWarm(name, models) {
+			continue
+		}
+		if node.URL == picked {
+			return picked // 选中的节点本身就是热节点
+		}
+		if stats.Queue != nil {
+			if _, ok := stats.Queue[node.URL]; !ok {
+				continue // 队列查询失败的节点不参与
+			}
+		}
+		if warm == "" || load(node.URL) < load(warm) {
+			warm = node.URL
+		}
+	}
+	if warm != "" && load(warm) <= queueLoad(load(picked), gap) {
+		LogAPIRuntime("[GetBestServer] 模型亲和：改选已加载模型的节点 %s（负载 %d，原节点 %s 负载 %d）", warm, load(warm), picked, load(picked))
+		return warm
+	}
+	return picked
+}
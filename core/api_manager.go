@@ -2,6 +2,7 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -24,32 +25,46 @@ type APIManager struct {
 	configFiles   map[string]string      // token -> 配置文件路径
 	fileModTimes  map[string]time.Time   // 文件路径 -> 最后修改时间
 	s3client      *S3Client
-	resourceDir   string // 资源目录路径
+	registry      *NodeRegistry      // 全局 ComfyUI 节点注册表（共享 WebSocket 连接）
+	fetcher       *URLFetcher        // 下载 URL 类型变量的文件
+	jobs          *JobStore          // 任务存储（同步 / 异步任务统一登记）
+	webhooks      *WebhookDispatcher // 任务完成回调
+	events        *EventBus          // 任务进度事件
+	pending       sync.Map           // job_id -> *QueuedPrompt，在网关队列中等待的任务
+	resourceDir   string             // 资源目录路径
 	mu            sync.RWMutex
 	stopCh        chan struct{}
 	wg            sync.WaitGroup
 	checkInterval time.Duration
 }
 
-func NewAPIManager(resource_dir string, s3config model.S3Config, checkInterval time.Duration, enabled bool) *APIManager {
-	s3client, err := NewS3Client(s3config) // 创建s3客户端
+func NewAPIManager(resource_dir string, cfg *model.Config) *APIManager {
+	s3client, err := NewS3Client(cfg.S3) // 创建s3客户端
 	if err != nil {
 		panic(err)
 	}
+	fetcher := NewURLFetcher(cfg.InputFetch) // URL 输入与任务回调共用地址检查
 	api_manager := &APIManager{
 		apis:          make(map[string]*APIRuntime), // ✅ 改成 *APIRuntime
 		configFiles:   make(map[string]string),
 		fileModTimes:  make(map[string]time.Time),
 		s3client:      s3client,
+		registry:      NewNodeRegistry(cfg.ComfyUI),
+		fetcher:       fetcher,
+		jobs:          NewJobStore(cfg.JobStore.Dir),
+		webhooks:      NewWebhookDispatcher(fetcher),
+		events:        NewEventBus(),
 		resourceDir:   resource_dir, // 记录资源目录
 		stopCh:        make(chan struct{}),
-		checkInterval: checkInterval,
+		checkInterval: time.Duration(cfg.HotReload.Interval) * time.Second,
 	}
 	api_manager.loadAPIs(resource_dir) // 加载api配置文件
 	// 🚀 策略：启动所有 API
 	api_manager.StartAll()
+	// 🚀 策略：对任务日志中未结束的任务进行对账
+	api_manager.recoverJobs()
 	// 🚀 策略：根据配置启动热重载监控
-	if enabled {
+	if cfg.HotReload.Enabled {
 		api_manager.StartHotReload()
 	}
 	return api_manager
@@ -67,9 +82,10 @@ func (api_manager *APIManager) loadAPIs(resource_dir string) {
 			continue
 		}
 		api_config_file := filepath.Join(resource_dir, file.Name())
-		apiruntime := NewAPIRuntime(api_config_file) // 创建APIRuntime实例
-		// 启动apiruntime
-		go apiruntime.Start()
+		apiruntime := api_manager.newAPIRuntime(api_config_file) // 创建APIRuntime实例
+		if apiruntime == nil {
+			continue
+		}
 		api_token := apiruntime.GetToken()
 		api_manager.apis[api_token] = apiruntime // ✅ 存入指针
 		api_manager.configFiles[api_token] = api_config_file
@@ -87,6 +103,59 @@ func (api_manager *APIManager) loadAPIs(resource_dir string) {
 	}
 }
 
+// newAPIRuntime 创建 APIRuntime 并注入任务监听者
+func (m *APIManager) newAPIRuntime(configPath string) *APIRuntime {
+	apiruntime := NewAPIRuntime(configPath, m.registry, m.fetcher)
+	if apiruntime == nil {
+		return nil
+	}
+	apiruntime.SetListener(m)
+	return apiruntime
+}
+
+// getAPI 根据 token 获取 APIRuntime（热重载期间加读锁）
+func (m *APIManager) getAPI(token string) (*APIRuntime, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	api, ok := m.apis[token]
+	return api, ok
+}
+
+// OnTaskStart 实现 TaskListener，ComfyUI 开始执行时更新任务状态
+func (m *APIManager) OnTaskStart(promptID string) {
+	if job, ok := m.jobs.GetByPrompt(promptID); ok {
+		m.setJobState(job.ID, JobRunning)
+	}
+}
+
+// OnTaskProgress 实现 TaskListener，按 job_id 发布进度事件
+func (m *APIManager) OnTaskProgress(event ProgressEvent) {
+	if job, ok := m.jobs.GetByPrompt(event.PromptID); ok {
+		event.JobID = job.ID
+		m.events.Publish(event)
+	}
+}
+
+// recoverJobs 网关重启后，重新等待任务日志中未结束的任务，并立即与节点的 /queue、/history 对账
+func (m *APIManager) recoverJobs() {
+	for _, job := range m.jobs.Unfinished() {
+		apiruntime, ok := m.getAPI(job.Token)
+		if !ok {
+			m.failJob(job.ID, fmt.Errorf("网关重启后未找到 api token %s", job.Token))
+			continue
+		}
+		if job.PromptID == "" {
+			m.failJob(job.ID, fmt.Errorf("网关重启，任务未提交到节点"))
+			continue
+		}
+
+		LogAPIRuntime("♻️ 恢复未结束任务 job_id=%s prompt_id=%s node=%s state=%s", job.ID, job.PromptID, job.Node, job.State)
+		task := apiruntime.Adopt(job.PromptID, job.Node)
+		go apiruntime.reconcileTask(task, false)
+		go m.runJob(job.ID, apiruntime, task)
+	}
+}
+
 // ---------------------------------- 控制逻辑 --------------------------------
 // 启动所有 API
 func (m *APIManager) StartAll() {
@@ -130,19 +199,43 @@ func (m *APIManager) StopAPI(token string) error {
 }
 
 // 获取状态列表
-func (m *APIManager) ListAPIs() []map[string]string {
-	list := []map[string]string{}
+func (m *APIManager) ListAPIs() []map[string]interface{} {
+	list := []map[string]interface{}{}
 	for token, api := range m.apis {
-		list = append(list, map[string]string{
-			"token":  token,
-			"name":   api.GetName(),
-			"status": api.GetStatus(),
-			"msg":    api.GetMessage(),
-		})
+		item := map[string]interface{}{
+			"token":     token,
+			"name":      api.GetName(),
+			"status":    api.GetStatus(),
+			"msg":       api.GetMessage(),
+			"scheduler": api.scheduler.Name(),
+			"queued":    api.queue.Len(),
+			"in_flight": api.activeCount(),
+			"nodes":     api.GetNodeStatuses(),
+		}
+		// 没有节点能运行本 API 的 prompt 时给出提示（缺少的自定义节点）
+		if warning := api.CapabilityWarning(); warning != "" {
+			item["warning"] = warning
+		}
+		list = append(list, item)
 	}
 	return list
 }
 
+// ListNodes 列出所有 ComfyUI 节点及其健康状态
+func (m *APIManager) ListNodes() []NodeStatus {
+	return m.registry.NodeStatuses()
+}
+
+// DrainNode 排空 / 恢复指定节点
+func (m *APIManager) DrainNode(name string, drained bool) (NodeStatus, bool) {
+	return m.registry.SetDrained(name, drained)
+}
+
+// GetNode 查询指定节点的健康状态
+func (m *APIManager) GetNode(name string) (NodeStatus, bool) {
+	return m.registry.NodeStatus(name)
+}
+
 // ---------------------------------- 热重载功能 --------------------------------
 // StartHotReload 启动热重载监控
 func (m *APIManager) StartHotReload() {
@@ -236,7 +329,7 @@ func (m *APIManager) checkConfigChanges() {
 
 // addNewAPI 添加新的API配置
 func (m *APIManager) addNewAPI(configPath string) {
-	newAPI := NewAPIRuntime(configPath)
+	newAPI := m.newAPIRuntime(configPath)
 	if newAPI == nil {
 		LogAPIRuntime("❌ 创建新APIRuntime失败: %s", configPath)
 		return
@@ -281,6 +374,7 @@ func (m *APIManager) removeDeletedAPI(configPath string) {
 	// 停止并移除API
 	if api, exists := m.apis[targetToken]; exists {
 		api.Stop()
+		api.DropQueued(fmt.Errorf("API 配置已删除"))
 		delete(m.apis, targetToken)
 		delete(m.configFiles, targetToken)
 		delete(m.fileModTimes, configPath)
@@ -297,12 +391,17 @@ func (m *APIManager) reloadAPI(token string, configPath string) {
 	}
 
 	// 加载新的配置
-	newAPI := NewAPIRuntime(configPath)
+	newAPI := m.newAPIRuntime(configPath)
 	if newAPI == nil {
 		LogAPIRuntime("❌ 创建新APIRuntime失败: %s", token)
 		return
 	}
 
+	// 接管旧服务中等待结果的任务，避免热重载导致任务丢失
+	if oldAPI, exists := m.apis[token]; exists {
+		newAPI.AdoptPending(oldAPI)
+	}
+
 	// 启动新的API服务
 	go newAPI.Start()
 
@@ -313,7 +412,7 @@ func (m *APIManager) reloadAPI(token string, configPath string) {
 
 // AddAPI 动态添加新的API配置
 func (m *APIManager) AddAPI(configPath string) error {
-	newAPI := NewAPIRuntime(configPath)
+	newAPI := m.newAPIRuntime(configPath)
 	if newAPI == nil {
 		return fmt.Errorf("创建APIRuntime失败")
 	}
@@ -344,6 +443,7 @@ func (m *APIManager) RemoveAPI(token string) {
 
 	if api, exists := m.apis[token]; exists {
 		api.Stop()
+		api.DropQueued(fmt.Errorf("API 配置已移除"))
 		delete(m.apis, token)
 		delete(m.configFiles, token)
 		LogAPIRuntime("🗑️ 移除API配置: %s", token)
@@ -358,6 +458,7 @@ func (m *APIManager) ReloadAllAPIs(resourceDir string) {
 	// 停止所有现有API
 	for token, api := range m.apis {
 		api.Stop()
+		api.DropQueued(fmt.Errorf("API 配置重新加载，排队中的请求已取消"))
 		LogAPIRuntime("🛑 停止API服务: %s", token)
 	}
 
@@ -378,7 +479,7 @@ func (m *APIManager) ReloadAllAPIs(resourceDir string) {
 			continue
 		}
 		api_config_file := filepath.Join(resourceDir, file.Name())
-		apiruntime := NewAPIRuntime(api_config_file)
+		apiruntime := m.newAPIRuntime(api_config_file)
 		if apiruntime == nil {
 			LogAPIRuntime("❌ 创建APIRuntime失败: %s", api_config_file)
 			continue
@@ -400,18 +501,279 @@ func (m *APIManager) ReloadAllAPIs(resourceDir string) {
 }
 
 // --------------------------------- 生成逻辑 ------------------------------------------
+// GenerateRequest 一次生成请求
+type GenerateRequest struct {
+	Token       string                 // API Token
+	Vars        map[string]interface{} // 替换变量
+	CallbackURL string                 // 任务结束后的回调地址（可选）
+	Priority    int                    // 排队优先级，越大越先提交到节点，默认 0
+	Files       map[string]InputFile   // 文件类型变量（multipart 上传），选出节点后上传到节点
+	// IdempotencyKey 幂等键（可选），同一 token 下相同的 key 只会提交一次，重试时挂到原任务上
+	IdempotencyKey string
+}
+
 // GenerateSync 调用对应 API 的同步生成逻辑，并上传结果到 S3
-func (api_manager *APIManager) GenerateSync(api_token string, vars map[string]interface{}) ([]string, error) {
-	apiruntime, ok := api_manager.apis[api_token]
+// ctx 结束（调用方断开连接）时自动取消任务，避免 GPU 执行无人接收的任务；
+// 携带幂等键时调用方会重试并挂到原任务上，因此不取消
+func (api_manager *APIManager) GenerateSync(ctx context.Context, req GenerateRequest) (Job, error) {
+	job, err := api_manager.GenerateAsync(req)
+	if err != nil {
+		return Job{}, err
+	}
+
+	select {
+	case <-api_manager.jobs.Done(job.ID):
+	case <-ctx.Done():
+		if req.IdempotencyKey != "" {
+			LogAPIRuntime(ColorYellow+"[GenerateSync] 调用方已断开，任务继续执行等待重试 job_id=%s", job.ID)
+			return Job{}, ctx.Err()
+		}
+		LogAPIRuntime(ColorYellow+"[GenerateSync] 调用方已断开，取消任务 job_id=%s", job.ID)
+		if _, err := api_manager.CancelJob(job.ID); err != nil {
+			LogAPIRuntime(ColorRed+"[GenerateSync] 取消任务失败: %s", err)
+		}
+		return Job{}, ctx.Err()
+	}
+
+	job, _ = api_manager.jobs.Get(job.ID)
+	if err := job.Err(); err != nil {
+		return job, err
+	}
+	return job, nil
+}
+
+// GenerateAsync 任务进入网关队列后立即返回任务信息，出队提交、下载结果并上传到 S3 均在后台进行
+// 队列已满时返回 *OverloadError
+func (api_manager *APIManager) GenerateAsync(req GenerateRequest) (Job, error) {
+	apiruntime, ok := api_manager.getAPI(req.Token)
 	if !ok {
-		return nil, fmt.Errorf("api token %s not found", api_token)
+		return Job{}, fmt.Errorf("api token %s not found", req.Token)
+	}
+	if req.CallbackURL != "" {
+		if apiruntime.GetCallbackSecret() == "" {
+			LogAPIRuntime(ColorRed+"[GenerateAsync] API %s 未配置 callback_secret，拒绝 callback_url", apiruntime.GetName())
+			return Job{}, fmt.Errorf("API %s 未配置 callback_secret，不支持 callback_url", apiruntime.GetName())
+		}
+		if err := api_manager.fetcher.CheckURL(context.Background(), req.CallbackURL); err != nil {
+			return Job{}, fmt.Errorf("invalid callback_url: %w", err)
+		}
+	}
+
+	job, created, err := api_manager.jobs.Create(req, apiruntime.GetName(), apiruntime.apiparser.omitInlineData(req.Vars))
+	if err != nil {
+		return Job{}, err
+	}
+	if !created {
+		// 相同幂等键的重试，直接返回原任务，不再提交到 ComfyUI
+		LogAPIRuntime("[GenerateAsync] 幂等键命中，返回原任务 job_id=%s state=%s", job.ID, job.State)
+		return job, nil
 	}
 
-	comfyui_urls, prompt_id, err := apiruntime.GenerateSync(vars)
+	queued, err := apiruntime.Enqueue(req.Vars, req.Files, req.Priority)
 	if err != nil {
-		return nil, fmt.Errorf("任务提交失败: %w", err)
+		err = fmt.Errorf("任务提交失败: %w", err)
+		api_manager.failJob(job.ID, err)
+		return Job{}, err
 	}
+	api_manager.pending.Store(job.ID, queued)
+
+	go api_manager.admitJob(job.ID, apiruntime, queued)
+
+	job, _ = api_manager.jobs.Get(job.ID)
+	return job, nil
+}
+
+// GetJob 查询任务状态，id 可以是 job_id 或 prompt_id
+func (api_manager *APIManager) GetJob(id string) (Job, bool) {
+	if job, ok := api_manager.jobs.Get(id); ok {
+		return job, true
+	}
+	return api_manager.jobs.GetByPrompt(id)
+}
+
+// SubscribeJob 订阅任务进度事件，返回事件通道、任务结束信号以及取消订阅函数
+func (api_manager *APIManager) SubscribeJob(id string) (<-chan ProgressEvent, <-chan struct{}, func(), bool) {
+	job, ok := api_manager.GetJob(id)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	events, cancel := api_manager.events.Subscribe(job.ID)
+	return events, api_manager.jobs.Done(job.ID), cancel, true
+}
+
+// CancelJob 取消任务，id 可以是 job_id 或 prompt_id
+func (api_manager *APIManager) CancelJob(id string) (Job, error) {
+	job, ok := api_manager.GetJob(id)
+	if !ok {
+		return Job{}, fmt.Errorf("job %s not found", id)
+	}
+	if job.State.IsFinished() {
+		return job, fmt.Errorf("job %s already %s", job.ID, job.State)
+	}
+
+	apiruntime, ok := api_manager.getAPI(job.Token)
+	if !ok {
+		return job, fmt.Errorf("api token %s not found", job.Token)
+	}
+	prompt_id := ""
+	if value, ok := api_manager.pending.Load(job.ID); ok {
+		// 还在网关队列中，直接取消排队；已经出队时取消提交到节点的 prompt
+		queued := value.(*QueuedPrompt)
+		if !queued.Cancel() {
+			if task, err := queued.Wait(context.Background()); err == nil {
+				prompt_id = task.PromptID
+			}
+		}
+	} else if job, ok = api_manager.jobs.Get(job.ID); ok {
+		// admitJob 移除 pending 前已记录 prompt_id，这里重新读取避免用到过期的快照
+		prompt_id = job.PromptID
+	}
+	if prompt_id != "" {
+		if err := apiruntime.Cancel(prompt_id); err != nil {
+			return job, err
+		}
+	}
+
+	// 等待 runJob 将任务标记为已取消
+	<-api_manager.jobs.Done(job.ID)
+	job, _ = api_manager.jobs.Get(job.ID)
+	return job, nil
+}
+
+// ListWebhookDeliveries 查询回调投递日志
+func (api_manager *APIManager) ListWebhookDeliveries(job_id string) []WebhookDelivery {
+	return api_manager.webhooks.Deliveries(job_id)
+}
+
+// admitJob 等待任务在网关队列中出队并提交到节点，然后继续等待执行结果
+// 先记录 prompt_id 或结束任务，再移除 pending，CancelJob 总能看到其中一种状态
+func (api_manager *APIManager) admitJob(job_id string, apiruntime *APIRuntime, queued *QueuedPrompt) {
+	task, err := queued.Wait(context.Background())
+	defer api_manager.pending.Delete(job_id)
+	if errors.Is(err, ErrTaskCancelled) {
+		api_manager.markCancelled(job_id)
+		return
+	}
+	if err != nil {
+		api_manager.failJob(job_id, fmt.Errorf("任务提交失败: %w", err))
+		return
+	}
+	api_manager.jobs.SetSubmitted(job_id, task.Host, task.PromptID, task.Tried)
+	api_manager.pending.Delete(job_id)
+	api_manager.publishJobState(job_id)
+	api_manager.runJob(job_id, apiruntime, task)
+}
+
+// runJob 等待 ComfyUI 执行结束，下载结果并上传到 S3，更新任务状态
+func (api_manager *APIManager) runJob(job_id string, apiruntime *APIRuntime, task *PromptTask) {
+	comfyui_outputs, err := apiruntime.Wait(task)
+	// 节点失联时按重试策略将同一个 prompt 转移到其他节点
+	for IsNodeFailure(err) {
+		next, resubmit_err := apiruntime.Resubmit(task)
+		if resubmit_err != nil {
+			LogAPIRuntime(ColorRed+"[runJob] 故障转移失败 job_id=%s: %s", job_id, resubmit_err)
+			break
+		}
+		LogAPIRuntime(ColorYellow+"[runJob] 节点 %s 失联，任务转移到 %s job_id=%s prompt_id=%s", task.Host, next.Host, job_id, next.PromptID)
+		api_manager.jobs.SetSubmitted(job_id, next.Host, next.PromptID, next.Tried)
+		api_manager.publishJobState(job_id)
+		task = next
+		comfyui_outputs, err = apiruntime.Wait(task)
+	}
+	if errors.Is(err, ErrTaskCancelled) {
+		api_manager.markCancelled(job_id)
+		return
+	}
+	if err != nil {
+		api_manager.failJob(job_id, waitFailure(err))
+		return
+	}
+
+	api_manager.setJobState(job_id, JobUploading)
+	s3_outputs := make([]model.NodeOutput, 0, len(comfyui_outputs))
+	for _, output := range comfyui_outputs {
+		s3_urls, err := api_manager.uploadOutputs(task.PromptID, output.URLs)
+		if err != nil {
+			api_manager.failJob(job_id, err)
+			return
+		}
+		output.URLs = s3_urls
+		s3_outputs = append(s3_outputs, output)
+	}
+	api_manager.jobs.Succeed(job_id, s3_outputs)
+	api_manager.publishJobState(job_id)
+	api_manager.notifyCallback(job_id)
+}
+
+// waitFailure 区分等待任务结果时的失败原因，保留原始错误（ExecutionError 等）供 errors.As 使用
+func waitFailure(err error) error {
+	var execErr *ExecutionError
+	switch {
+	case errors.As(err, &execErr):
+		return fmt.Errorf("任务执行失败: %w", err)
+	case errors.Is(err, ErrWaitTimeout):
+		return fmt.Errorf("任务执行超时: %w", err)
+	case IsNodeFailure(err):
+		return fmt.Errorf("任务执行中断: %w", err)
+	}
+	return fmt.Errorf("任务执行失败: %w", err)
+}
+
+// failJob 任务失败并触发回调
+func (api_manager *APIManager) failJob(job_id string, err error) {
+	api_manager.jobs.Fail(job_id, err)
+	api_manager.publishJobState(job_id)
+	api_manager.notifyCallback(job_id)
+}
+
+// markCancelled 任务已取消并触发回调
+func (api_manager *APIManager) markCancelled(job_id string) {
+	api_manager.jobs.Cancel(job_id)
+	api_manager.publishJobState(job_id)
+	api_manager.notifyCallback(job_id)
+}
+
+// setJobState 更新任务状态并发布状态事件
+func (api_manager *APIManager) setJobState(job_id string, state JobState) {
+	api_manager.jobs.SetState(job_id, state)
+	api_manager.publishJobState(job_id)
+}
+
+// publishJobState 发布任务当前状态
+func (api_manager *APIManager) publishJobState(job_id string) {
+	job, ok := api_manager.jobs.Get(job_id)
+	if !ok {
+		return
+	}
+	api_manager.events.Publish(NewJobStateEvent(job))
+}
+
+// notifyCallback 任务结束后，如果调用方提供了 callback_url 则投递回调
+func (api_manager *APIManager) notifyCallback(job_id string) {
+	job, ok := api_manager.jobs.Get(job_id)
+	if !ok || job.Callback == "" {
+		return
+	}
+	secret := ""
+	if apiruntime, ok := api_manager.getAPI(job.Token); ok {
+		secret = apiruntime.GetCallbackSecret()
+	}
+	api_manager.webhooks.Dispatch(job.Callback, secret, WebhookPayload{
+		JobID:    job.ID,
+		APIName:  job.APIName,
+		PromptID: job.PromptID,
+		Node:     job.Node,
+		Tried:    job.Tried,
+		State:    job.State,
+		URLs:     job.URLs,
+		Outputs:  job.Outputs,
+		Error:    job.Error,
+		Detail:   job.ErrorInfo,
+	})
+}
 
+// uploadOutputs 下载 ComfyUI 生成的文件并上传到 S3，返回 S3 地址
+func (api_manager *APIManager) uploadOutputs(prompt_id string, comfyui_urls []string) ([]string, error) {
 	s3_urls := make([]string, 0, len(comfyui_urls)) // ✅ 不要预填充
 
 	for _, comfyui_url := range comfyui_urls {
@@ -3,11 +3,15 @@ package core
 import (
 	"encoding/json"
 	"errors"
+	"farshore.ai/fast-comfy-api/config"
 	"farshore.ai/fast-comfy-api/model"
 	"fmt"
 	"github.com/google/uuid"
+	"maps"
 	"math/rand"
 	"reflect"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 )
@@ -22,6 +26,15 @@ func NewAPIParser(apijson []byte) (*APIParser, error) {
 	if err := json.Unmarshal(apijson, api); err != nil {
 		return nil, err
 	}
+	// mask 变量必须指向一个 image 变量，上传时以该图片为 original_ref
+	for name, def := range api.Variables {
+		if def.Type != VariableTypeMask {
+			continue
+		}
+		if original, ok := api.Variables[def.Original]; !ok || original.Type != VariableTypeImage {
+			return nil, fmt.Errorf("mask 变量 '%s' 的 original 必须是 image 类型的变量", name)
+		}
+	}
 	return &APIParser{api: api}, nil
 }
 
@@ -66,6 +79,139 @@ func (p *APIParser) GetToken() string {
 	return p.api.Token
 }
 
+func (p *APIParser) GetCallbackSecret() string {
+	if p.api == nil {
+		return ""
+	}
+	return p.api.CallbackSecret
+}
+
+func (p *APIParser) GetScheduler() string {
+	if p.api == nil {
+		return ""
+	}
+	return p.api.Scheduler
+}
+
+func (p *APIParser) GetNodeWeights() map[string]int {
+	if p.api == nil {
+		return nil
+	}
+	return p.api.NodeWeights
+}
+
+// GetMaxAttempts 获取最多尝试的节点数（包含首次提交）
+func (p *APIParser) GetMaxAttempts() int {
+	if p.api == nil || p.api.Retry.MaxAttempts <= 1 {
+		return 1
+	}
+	return p.api.Retry.MaxAttempts
+}
+
+// GetMinFreeVRAM 获取节点最少空闲显存要求（MB），0 表示不要求
+func (p *APIParser) GetMinFreeVRAM() int64 {
+	if p.api == nil {
+		return 0
+	}
+	return p.api.MinFreeVRAM
+}
+
+// GetAffinityGap 获取模型亲和调度允许的负载差，-1 表示关闭
+func (p *APIParser) GetAffinityGap() int {
+	if p.api == nil || p.api.Affinity.MaxQueueGap == nil {
+		return 0
+	}
+	return *p.api.Affinity.MaxQueueGap
+}
+
+// GetMaxQueueSize 获取网关队列长度上限
+func (p *APIParser) GetMaxQueueSize() int {
+	if p.api == nil || p.api.MaxQueueSize <= 0 {
+		return config.DefaultMaxQueueSize
+	}
+	return p.api.MaxQueueSize
+}
+
+// GetMaxConcurrent 获取本 API 同时在节点上执行的任务数上限，0 表示不限制
+func (p *APIParser) GetMaxConcurrent() int {
+	if p.api == nil || p.api.MaxConcurrent <= 0 {
+		return 0
+	}
+	return p.api.MaxConcurrent
+}
+
+// GetMaxQueueWait 获取请求在网关队列中的最长等待时间，0 表示不限制
+func (p *APIParser) GetMaxQueueWait() time.Duration {
+	if p.api == nil || p.api.MaxQueueWait <= 0 {
+		return 0
+	}
+	return time.Duration(p.api.MaxQueueWait) * time.Second
+}
+
+// GetMaxBase64Size 获取 data URI / base64 文件解码后的大小上限（MB），0 表示按变量类型的默认上限
+func (p *APIParser) GetMaxBase64Size() int {
+	if p.api == nil || p.api.MaxBase64Size <= 0 {
+		return 0
+	}
+	return p.api.MaxBase64Size
+}
+
+// GetVariablePath 获取变量写入的 path，未填 path 的 mask 变量写入配对图片的 path
+func (p *APIParser) GetVariablePath(name string) string {
+	def, _ := p.GetVariable(name)
+	if def.Type == VariableTypeMask && def.Path == "" {
+		original, _ := p.GetVariable(def.Original)
+		return original.Path
+	}
+	return def.Path
+}
+
+// GetVariable 获取变量定义
+func (p *APIParser) GetVariable(name string) (model.Variable, bool) {
+	if p.api == nil {
+		return model.Variable{}, false
+	}
+	def, ok := p.api.Variables[name]
+	return def, ok
+}
+
+// GetNodeTitle 获取节点标题（_meta.title）
+func (p *APIParser) GetNodeTitle(nodeID string) string {
+	if p.api == nil {
+		return ""
+	}
+	return p.api.Prompt[nodeID].Meta.Title
+}
+
+// GetNodeCount 获取 prompt 节点数量
+func (p *APIParser) GetNodeCount() int {
+	if p.api == nil {
+		return 0
+	}
+	return len(p.api.Prompt)
+}
+
+// GetClassTypes 获取 prompt 中用到的节点类型（排序去重），用于能力路由
+func (p *APIParser) GetClassTypes() []string {
+	if p.api == nil {
+		return nil
+	}
+	classTypes := make([]string, 0, len(p.api.Prompt))
+	for _, node := range p.api.Prompt {
+		classTypes = append(classTypes, node.ClassType)
+	}
+	sort.Strings(classTypes)
+	return slices.Compact(classTypes)
+}
+
+// GetTimeout 获取任务等待超时时间，未配置时使用默认值
+func (p *APIParser) GetTimeout() time.Duration {
+	if p.api == nil || p.api.Timeout <= 0 {
+		return config.DefaultTaskTimeout * time.Second
+	}
+	return time.Duration(p.api.Timeout) * time.Second
+}
+
 // ApplyVariables 将传入变量替换进 Prompt 中的指定路径，返回新的 Prompt
 func (p *APIParser) ApplyVariables(vars map[string]interface{}) (map[string]model.PromptNode, error) {
 	if p.api == nil {
@@ -89,6 +235,11 @@ func (p *APIParser) ApplyVariables(vars map[string]interface{}) (map[string]mode
 			// 如果没传入，用默认值
 			val = def.Default
 		}
+		// mask 变量只在上传遮罩时生效（上传后写入 path，未填时写入配对图片的 path），
+		// 不能用默认值覆盖与图片共用的 path
+		if def.Type == VariableTypeMask && (!exists || def.Path == "") {
+			continue
+		}
 
 		// 跳过空路径
 		if def.Path == "" {
@@ -124,7 +275,8 @@ func (p *APIParser) ApplyVariables(vars map[string]interface{}) (map[string]mode
 			return nil, fmt.Errorf("变量 '%s' 类型不匹配，应为 %s，实际是 %T", varName, def.Type, val)
 		}
 
-		// ✅ 替换
+		// ✅ 替换（复制 inputs，避免并发请求修改同一份配置）
+		node.Inputs = maps.Clone(node.Inputs)
 		node.Inputs[key] = val
 		promptCopy[nodeID] = node
 	}
@@ -157,6 +309,11 @@ func checkType(expected string, val interface{}) bool {
 	case "bool":
 		_, ok := val.(bool)
 		return ok
+	case VariableTypeImage, VariableTypeMask, VariableTypeAudio, VariableTypeVideo,
+		VariableTypeImageURL, VariableTypeAudioURL, VariableTypeVideoURL:
+		// 文件名或 URL，文件在选定节点后上传并替换
+		_, ok := val.(string)
+		return ok
 	case "object":
 		// 任意 map
 		_, ok := val.(map[string]interface{})
@@ -1,7 +1,9 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"farshore.ai/fast-comfy-api/config"
 	"farshore.ai/fast-comfy-api/model"
 	"farshore.ai/fast-comfy-api/utils"
@@ -9,8 +11,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -34,22 +38,232 @@ type APIRuntime struct {
 	msg string
 
 	// ***************
-	workerlist []*MessageWorker // 存放所有服务器的websocket消息消费者
+	registry *NodeRegistry // 全局节点注册表，节点的 WebSocket 连接由所有 API 共享
+	fetcher  *URLFetcher   // 下载 URL 类型变量的文件，所有 API 共享
+	nodes    []*ComfyNode  // comfyui_nodes 解析后的节点
 
-	waiting sync.Map // 存放等待通知的任务
+	waiting sync.Map // 存放等待通知的任务 prompt_id -> *PromptTask
+
+	listener TaskListener // 任务生命周期监听者（APIManager）
+
+	watchStop chan struct{} // 停止 /history 对账协程
+
+	scheduler Scheduler // 节点调度策略
+
+	queue      *promptQueue // 网关队列，节点有空闲容量时才出队提交
+	committing atomic.Int32 // 已出队正在提交的任务数，计入 max_concurrent
+}
+
+// PromptTask 已提交到 ComfyUI、等待结果的任务
+type PromptTask struct {
+	PromptID string   // ComfyUI 返回的 prompt_id
+	Host     string   // 执行任务的节点
+	Tried    []string // 已尝试过的节点（包含当前节点），按尝试顺序
+	done     chan taskResult
+	progress *promptProgress // 节点完成情况，用于计算整体进度
+
+	prompt   map[string]model.PromptNode // 变量替换后的 prompt，故障转移时原样重新提交（保证 seed 一致），重启恢复的任务为空
+	priority int                         // 排队优先级，故障转移重新排队时沿用
+	files    map[string]InputFile        // 文件类型变量，故障转移时重新上传到新节点
+
+	mu        sync.Mutex
+	outputs   []*nodeAddresses // 各输出节点的结果，按 executed 到达顺序
+	lastEvent time.Time        // 最近一次收到该任务事件的时间
+}
+
+// nodeAddresses 单个输出节点的文件地址
+type nodeAddresses struct {
+	nodeID    string
+	addresses []model.Address
+}
+
+// addOutput 收集输出节点结果，同一节点多次 executed 时合并
+func (t *PromptTask) addOutput(nodeID string, addresses []model.Address) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, output := range t.outputs {
+		if output.nodeID == nodeID {
+			output.addresses = append(output.addresses, addresses...)
+			return
+		}
+	}
+	t.outputs = append(t.outputs, &nodeAddresses{nodeID: nodeID, addresses: addresses})
+}
+
+// takeOutputs 取出已收集的结果
+func (t *PromptTask) takeOutputs() []*nodeAddresses {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	outputs := t.outputs
+	t.outputs = nil
+	return outputs
+}
+
+// taskResult 任务结果，err 不为空表示失败或被取消
+type taskResult struct {
+	outputs []*nodeAddresses
+	err     error
+}
+
+// ErrTaskCancelled 任务被取消
+var ErrTaskCancelled = errors.New("任务已取消")
+
+// ErrWaitTimeout 超过 API 配置的 timeout 仍未收到任务结果
+var ErrWaitTimeout = errors.New("等待超时，任务结果未收到")
+
+// ExecutionError ComfyUI 执行失败（execution_error / execution_interrupted）
+type ExecutionError struct {
+	PromptID         string   `json:"prompt_id"`
+	NodeID           string   `json:"node_id"`
+	NodeType         string   `json:"node_type"`
+	ExceptionType    string   `json:"exception_type,omitempty"`
+	ExceptionMessage string   `json:"exception_message"`
+	Traceback        []string `json:"traceback,omitempty"`
+	Interrupted      bool     `json:"interrupted,omitempty"` // 是否为中断
+}
+
+func (e *ExecutionError) Error() string {
+	if e.Interrupted {
+		return fmt.Sprintf("节点 %s(%s) 执行被中断", e.NodeID, e.NodeType)
+	}
+	return fmt.Sprintf("节点 %s(%s) 执行失败: %s", e.NodeID, e.NodeType, e.ExceptionMessage)
+}
+
+// TaskListener 任务生命周期监听接口，由 APIManager 实现，用于更新任务状态
+type TaskListener interface {
+	OnTaskStart(promptID string)
+	OnTaskProgress(event ProgressEvent)
+}
+
+// SetListener 注入任务生命周期监听者
+func (api *APIRuntime) SetListener(listener TaskListener) {
+	api.listener = listener
 }
 
 // ✅ 实现 TaskNotifier 接口
-func (api *APIRuntime) NotifyTaskDone(promptID string, addresses []model.Address) {
-	LogAPIRuntime("🚄 [NotifyTaskDone] 任务完成，prompt_id=%s, 地址列表=%s", promptID, addresses)
-	if ch, ok := api.waiting.Load(promptID); ok {
-		ch.(chan []model.Address) <- addresses
-		api.waiting.Delete(promptID)
+func (api *APIRuntime) NotifyTaskDone(promptID string) {
+	value, ok := api.waiting.Load(promptID)
+	if !ok {
+		return
+	}
+	task := value.(*PromptTask)
+	outputs := task.takeOutputs()
+	if len(outputs) == 0 {
+		// 没有收到 executed 消息，从 /history 补全结果
+		go api.fetchHistoryOutputs(task)
+		return
+	}
+	if api.finishTask(promptID, taskResult{outputs: outputs}) {
+		LogAPIRuntime("🚄 [NotifyTaskDone] 任务完成，prompt_id=%s, 输出节点数量=%d", promptID, len(outputs))
+	}
+}
+
+// NotifyNodeOutput 收集单个输出节点的结果，仅保留 output 类型（忽略预览等临时文件）
+func (api *APIRuntime) NotifyNodeOutput(promptID string, nodeID string, addresses []model.Address) {
+	value, ok := api.waiting.Load(promptID)
+	if !ok {
+		return
+	}
+	outputs := make([]model.Address, 0, len(addresses))
+	for _, address := range addresses {
+		if address.Type == "" || address.Type == "output" {
+			outputs = append(outputs, address)
+		}
+	}
+	if len(outputs) == 0 {
+		return
+	}
+	task := value.(*PromptTask)
+	task.touch()
+	task.addOutput(nodeID, outputs)
+}
+
+// NotifyTaskFailed ComfyUI 执行失败，立即释放等待者
+func (api *APIRuntime) NotifyTaskFailed(promptID string, err *ExecutionError) {
+	if api.finishTask(promptID, taskResult{err: err}) {
+		LogAPIRuntime(ColorRed+"🚄 [NotifyTaskFailed] 任务失败，prompt_id=%s, err=%s", promptID, err)
+	}
+}
+
+// NotifyConnectionLost 节点 WebSocket 断开或熔断时，立即对账该节点上的任务，节点不可达的任务按失联处理
+func (api *APIRuntime) NotifyConnectionLost(host string) {
+	api.waiting.Range(func(_, value interface{}) bool {
+		task := value.(*PromptTask)
+		if normalizeHost(task.Host) == normalizeHost(host) {
+			go api.reconcileTask(task, true)
+		}
+		return true
+	})
+}
+
+// finishTask 将结果交给等待者，每个任务只会被通知一次
+func (api *APIRuntime) finishTask(promptID string, result taskResult) bool {
+	task, ok := api.waiting.LoadAndDelete(promptID)
+	if !ok {
+		return false
+	}
+	api.registry.Disown(promptID, api)
+	task.(*PromptTask).done <- result
+	return true
+}
+
+// Cancel 取消任务：排队中则从节点队列删除，执行中则中断，并释放等待者
+func (api *APIRuntime) Cancel(promptID string) error {
+	value, ok := api.waiting.Load(promptID)
+	if !ok {
+		return fmt.Errorf("prompt_id %s 不在等待中", promptID)
+	}
+	task := value.(*PromptTask)
+
+	stopPrompt(task.Host, promptID)
+	api.finishTask(promptID, taskResult{err: ErrTaskCancelled})
+	LogAPIRuntime(ColorYellow+"[Cancel] 任务已取消 prompt_id=%s host=%s", promptID, task.Host)
+	return nil
+}
+
+// stopPrompt 停止节点上的 prompt：排队中则从队列删除，执行中则中断
+func stopPrompt(host, promptID string) {
+	running, pending, err := GetComfyuiQueue(host)
+	if err != nil {
+		LogAPIRuntime(ColorRed+"[Cancel] 获取节点队列失败: %s", err)
+	} else if slices.Contains(pending, promptID) {
+		if err := DeleteFromQueue(host, promptID); err != nil {
+			LogAPIRuntime(ColorRed+"[Cancel] 删除排队任务失败: %s", err)
+		}
+	} else if slices.Contains(running, promptID) {
+		if err := InterruptPrompt(host, promptID); err != nil {
+			LogAPIRuntime(ColorRed+"[Cancel] 中断任务失败: %s", err)
+		}
+	}
+}
+
+// NotifyTaskStart 任务开始执行
+func (api *APIRuntime) NotifyTaskStart(promptID string) {
+	task, ok := api.waiting.Load(promptID)
+	if !ok {
+		return
+	}
+	task.(*PromptTask).touch()
+	if api.listener != nil {
+		api.listener.OnTaskStart(promptID)
+	}
+}
+
+// NotifyProgress 计算整体进度后转交给监听者
+func (api *APIRuntime) NotifyProgress(event ProgressEvent) {
+	task, ok := api.waiting.Load(event.PromptID)
+	if !ok {
+		return
+	}
+	task.(*PromptTask).touch()
+	task.(*PromptTask).progress.apply(&event)
+	if api.listener != nil {
+		api.listener.OnTaskProgress(event)
 	}
 }
 
 // 初始化 API 运行时
-func NewAPIRuntime(apijson_path string) *APIRuntime {
+func NewAPIRuntime(apijson_path string, registry *NodeRegistry, fetcher *URLFetcher) *APIRuntime {
 	// 读取json 文件
 	apijson, err := ioutil.ReadFile(apijson_path)
 	if err != nil {
@@ -62,43 +276,58 @@ func NewAPIRuntime(apijson_path string) *APIRuntime {
 		LogAPIRuntime(ColorRed+"解析 API 配置失败: %s", err)
 		return nil
 	}
+	// 解析 comfyui_nodes 中引用的节点名称 / 标签
+	nodes, err := registry.Resolve(apiparser.GetComfyuiNodes())
+	if err != nil {
+		LogAPIRuntime(ColorRed+"解析 API 配置失败: %s", err)
+		return nil
+	}
+	// 创建调度策略，node_weights 可以用节点名称或地址作为键
+	weights := make(map[string]int)
+	for _, node := range nodes {
+		if weight, ok := apiparser.GetNodeWeights()[node.Name]; ok {
+			weights[node.URL] = weight
+		} else if weight, ok := apiparser.GetNodeWeights()[node.URL]; ok {
+			weights[node.URL] = weight
+		}
+	}
+	scheduler, err := NewScheduler(apiparser.GetScheduler(), weights)
+	if err != nil {
+		LogAPIRuntime(ColorRed+"解析 API 配置失败: %s", err)
+		return nil
+	}
 	// 初始化 API 运行时，状态为离线
 	return &APIRuntime{
 		apiparser: apiparser,
 		status:    "offline",
+		registry:  registry,
+		fetcher:   fetcher,
+		nodes:     nodes,
+		scheduler: scheduler,
+		queue:     newPromptQueue(),
 	}
 }
 
 // 启动 API 服务
 func (api *APIRuntime) Start() {
-	// 1.获取api的comfyui nodes
-	comfyui_nodes := api.apiparser.GetComfyuiNodes()
-	// 获取token
-	token := api.apiparser.GetToken()
-	// comfyui_nodes 视为 hosts, token 视为 clientID
-	clientID := token
-	// 为所有服务器建立连接
-	for _, node := range comfyui_nodes {
-		host := normalizeHost(node)
-		// 创建websocket消息消费者,注入APi 作为 notifier
-		messageworker := NewMessageWorker(host, clientID, api)
-		// 存入 workerlist
-		api.workerlist = append(api.workerlist, messageworker)
-		// 启动消息消费者
-		err := messageworker.Start()
+	// 1. 启动 /history 对账协程（兜底 WebSocket 消息丢失）与网关队列调度协程，部分节点连接失败时其他节点照常调度
+	if api.watchStop == nil {
+		api.watchStop = make(chan struct{})
+		go api.watchPending(api.watchStop)
+		go api.dispatchLoop(api.watchStop)
+	}
+	// 2. 确保所有节点的共享 WebSocket 连接已建立，事件由注册表按 prompt_id 分发回本 API
+	for _, node := range api.nodes {
+		err := api.registry.Connect(node)
 		if err != nil {
 			LogAPIRuntime(ColorRed+"启动消息消费者失败: %s", err)
 			// 记录错误信息
-			api.msg = fmt.Sprintf(ColorRed+"%s 节点启动失败，请检查失败节点或者将其移除后重试 %s", host, err)
+			api.msg = fmt.Sprintf(ColorRed+"%s 节点启动失败，请检查失败节点或者将其移除后重试 %s", node.Name, err)
 			api.status = "exception"
-			// 清空 workerlist
-			api.workerlist = []*MessageWorker{}
 			return
-
 		}
-
 	}
-	// 2. 启动成功，状态为在线
+	// 3. 启动成功，状态为在线
 	api.status = "online"
 	api.msg = "API 服务已启动"
 }
@@ -124,9 +353,10 @@ func normalizeHost(node string) string {
 
 // 停止 API 服务
 func (api *APIRuntime) Stop() {
-	// 1. 关闭所有 websocket 连接
-	for _, worker := range api.workerlist {
-		worker.Stop()
+	// 1. 节点的 websocket 连接由注册表共享，这里只停止本 API 的对账与调度协程，排队中的请求保留
+	if api.watchStop != nil {
+		close(api.watchStop)
+		api.watchStop = nil
 	}
 	// 2. 状态为离线
 	api.status = "offline"
@@ -142,6 +372,55 @@ func (api *APIRuntime) Restart() {
 	api.Start()
 }
 
+// GetNodeURLs 获取本 API 可用节点的地址
+func (api *APIRuntime) GetNodeURLs() []string {
+	urls := make([]string, 0, len(api.nodes))
+	for _, node := range api.nodes {
+		urls = append(urls, node.URL)
+	}
+	return urls
+}
+
+// routableNodes 获取能够执行本 API 的节点：未熔断、未排空、不在 exclude 中、支持 prompt 中的全部节点类型
+// 这些节点只是暂时资源不足时，请求留在网关队列中等待
+func (api *APIRuntime) routableNodes(exclude []string) []*ComfyNode {
+	healthy := make([]*ComfyNode, 0, len(api.nodes))
+	for _, node := range api.nodes {
+		if node.Healthy() && !node.drained.Load() && !slices.Contains(exclude, node.URL) {
+			healthy = append(healthy, node)
+		}
+	}
+	return filterByCapabilities(healthy, api.apiparser.GetClassTypes())
+}
+
+// candidateNodes 获取可参与调度的节点地址：在 routableNodes 的基础上资源满足要求，prompt 用于判断热节点
+func (api *APIRuntime) candidateNodes(prompt map[string]model.PromptNode, exclude []string) []string {
+	name, models := api.GetName(), promptModels(prompt)
+	candidates := api.registry.filterByResources(api.routableNodes(exclude), api.apiparser.GetMinFreeVRAM(), func(node *ComfyNode) bool {
+		return node.isWarm(name, models)
+	})
+	return nodeURLs(candidates)
+}
+
+// 辅助函数：节点地址列表
+func nodeURLs(nodes []*ComfyNode) []string {
+	urls := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		urls = append(urls, node.URL)
+	}
+	return urls
+}
+
+// GetNodeStatuses 获取本 API 节点的状态
+func (api *APIRuntime) GetNodeStatuses() []NodeStatus {
+	inFlight := api.registry.InFlight()
+	list := make([]NodeStatus, 0, len(api.nodes))
+	for _, node := range api.nodes {
+		list = append(list, node.status(inFlight[node.URL]))
+	}
+	return list
+}
+
 // 获取API 名字
 func (api *APIRuntime) GetName() string {
 	if api.apiparser == nil {
@@ -158,6 +437,14 @@ func (api *APIRuntime) GetToken() string {
 	return api.apiparser.GetToken()
 }
 
+// 获取回调签名密钥
+func (api *APIRuntime) GetCallbackSecret() string {
+	if api.apiparser == nil {
+		return ""
+	}
+	return api.apiparser.GetCallbackSecret()
+}
+
 // 获取当前状态
 func (api *APIRuntime) GetStatus() string {
 	return api.status
@@ -168,24 +455,64 @@ func (api *APIRuntime) GetMessage() string {
 	return api.msg
 }
 
-// 辅助函数 GetBestHost 选取一个最佳 host 节点
-
-// 🫱🫱🫱 贪婪策略，任务抵达时，检查所有nodes的服务器的队列数量，选择最小队列数量的node 作为最佳节点
-
-func (api *APIRuntime) GetBestServer() string {
-	// step 1️⃣ 获取所有节点的服务器列表
-	nodes := api.apiparser.GetComfyuiNodes()
+// GetBestServer 按 API 配置的调度策略，在在途数量低于容量的节点中选取一个并预占，提交完成后需调用 registry.Release
+// exclude 中的节点不参与选择（故障转移时排除已尝试过的节点），prompt 用于模型亲和；没有空闲节点时返回空字符串
+func (api *APIRuntime) GetBestServer(prompt map[string]model.PromptNode, exclude ...string) string {
+	// step 1️⃣ 获取所有健康节点的服务器列表
+	nodes := api.candidateNodes(prompt, exclude)
 	if len(nodes) == 0 {
-		LogAPIRuntime("[GetBestServer] 没有节点")
+		LogAPIRuntime("[GetBestServer] 没有可用节点（熔断、排空或资源不满足要求）")
 		return "" // 没有节点就返回空
 	}
-	// 如果只有一个节点，直接返回
-	if len(nodes) == 1 {
-		LogAPIRuntime("[GetBestServer] 只有一个节点，直接返回")
-		return nodes[0]
+	// 2️⃣ 策略需要时，并发获取所有节点的当前队列数量
+	stats := NodeStats{}
+	if api.scheduler.NeedQueue() {
+		stats.Queue = api.getQueueMap(nodes)
+	}
+	stats.Capacity = make(map[string]int, len(api.nodes))
+	for _, node := range api.nodes {
+		stats.Capacity[node.URL] = node.Capacity
+	}
+	// 3️⃣ 在锁内统计在途数量、选取节点并预占，避免并发请求（包括其他 API）同时选中同一节点
+	registry := api.registry
+	registry.reserveMu.Lock()
+	stats.Reserved = make(map[string]int, len(registry.reserved))
+	for node, count := range registry.reserved {
+		stats.Reserved[node] = count
+	}
+	stats.InFlight = registry.InFlight()
+	for node, count := range stats.Reserved {
+		stats.InFlight[node] += count
+	}
+	// 只在在途数量低于容量的节点中选择
+	free := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if stats.InFlight[node] < stats.Capacity[node] {
+			free = append(free, node)
+		}
+	}
+	// 只有一个空闲节点时同样交给调度策略，策略可以拒绝（如权重为 0、队列查询失败）
+	best_node := ""
+	if len(free) > 0 {
+		best_node = api.scheduler.Pick(free, stats)
+		best_node = api.preferWarm(best_node, free, stats, promptModels(prompt))
+	}
+	if best_node != "" {
+		registry.reserved[best_node]++
+	}
+	registry.reserveMu.Unlock()
+	if best_node == "" {
+		return ""
 	}
-	// 2️⃣ 遍历所有节点，获取服务器的当前队列数量，使用 go 并发获取
+	// 4️⃣ 打印日志
+	LogAPIRuntime(ColorGreen+"[GetBestServer] 策略: %s, 选取节点: %s, 队列数量: %v, 在途数量: %v", api.scheduler.Name(), best_node, stats.Queue, stats.InFlight)
+	return best_node
+}
+
+// getQueueMap 并发获取节点的队列数量，查询失败的节点不在结果中
+func (api *APIRuntime) getQueueMap(nodes []string) map[string]int {
 	queue_map := make(map[string]int)
+	var queue_mu sync.Mutex
 	var wg sync.WaitGroup
 	for _, node := range nodes {
 		wg.Add(1)
@@ -196,22 +523,13 @@ func (api *APIRuntime) GetBestServer() string {
 				LogAPIRuntime(ColorYellow+"[GetBestServer] 获取服务器队列数量失败: %s", err)
 				return
 			}
+			queue_mu.Lock()
 			queue_map[node] = queue_remaining
+			queue_mu.Unlock()
 		}(node)
 	}
 	wg.Wait()
-	// 3️⃣ 选取最小队列数量的节点作为最佳节点
-	min_queue := int(^uint(0) >> 1) // 最大值
-	best_node := ""
-	for node, queue := range queue_map {
-		if queue < min_queue {
-			min_queue = queue
-			best_node = node
-		}
-	}
-	// 4️⃣ 打印日志
-	LogAPIRuntime(ColorGreen+"[GetBestServer] 选取节点: %s, 队列数量: %d", best_node, min_queue)
-	return best_node
+	return queue_map
 }
 
 // 辅助函数 获取服务器的当前队列数量
@@ -250,70 +568,93 @@ func (api *APIRuntime) GetComfyuiServerQueue(host string) (int, error) {
 	return int(queue_remaining), nil
 }
 
-/*
-func (api *APIRuntime) GetBestServer() string {
-	nodes := api.apiparser.GetComfyuiNodes()
-	if len(nodes) == 0 {
-		return "" // 没有节点就返回空
+// Resubmit 任务所在节点失联时，将同一个 prompt 重新排队提交到未尝试过的健康节点
+func (api *APIRuntime) Resubmit(task *PromptTask) (*PromptTask, error) {
+	if task.prompt == nil {
+		return nil, fmt.Errorf("任务没有可重新提交的 prompt")
 	}
-
-	// 初始化随机种子
-	rand.Seed(time.Now().UnixNano())
-	index := rand.Intn(len(nodes))
-
-	// 打印日志
-	log.Printf("[GetBestServer]  选取节点: %s", nodes[index])
-	return nodes[index]
-}
-
-*/
-
-// 同步生成接口，输入变量json, 返回资源url list, error
-
-func (api *APIRuntime) GenerateSync(vars map[string]interface{}) ([]string, string, error) {
-	// 1️⃣ 获取变量替换后的 prompt
-	prompt_node, err := api.apiparser.ApplyVariables(vars)
+	// 旧 prompt 已在 finishTask 中移出等待列表并解除归属，旧节点之后的事件找不到接收者，直接丢弃；
+	// 网关不再跟踪旧 prompt，尽量停止旧节点上的任务（排队中删除、执行中中断），避免同一个 prompt 执行两次
+	go stopPrompt(task.Host, task.PromptID)
+	// 已被接纳过的任务不受队列长度限制，排在同优先级请求之前
+	queued, err := api.enqueue(task.prompt, task.files, task.Tried, task.priority, 0, 0)
 	if err != nil {
-		LogAPIRuntime("变量替换失败: %s", err)
-		return nil, "", err
+		return nil, err
 	}
-
-	// 2️⃣ 随机向一个节点提交任务，并获取 prompt_id
-	target_server := api.GetBestServer()
-	if target_server == "" {
-		LogAPIRuntime("没有可用的节点")
-		return nil, "", fmt.Errorf("没有可用的节点")
+	next, err := queued.Wait(context.Background())
+	if err != nil {
+		return nil, err
 	}
+	return next, nil
+}
 
-	ClientID := api.apiparser.GetToken()
-	prompt_id, err := PromptCommit(target_server, prompt_node, ClientID)
-	if err != nil {
-		LogAPIRuntime("提交任务失败: %s", err)
-		return nil, prompt_id, err // ✅ prompt_id 已经生成，返回给调用方
+// Adopt 注册等待一个已提交到节点的 prompt（提交后 / 重启恢复）
+func (api *APIRuntime) Adopt(promptID, host string) *PromptTask {
+	task := &PromptTask{
+		PromptID:  promptID,
+		Host:      host,
+		done:      make(chan taskResult, 1),
+		progress:  newPromptProgress(api.apiparser.GetNodeCount()),
+		lastEvent: time.Now(),
 	}
+	api.waiting.Store(promptID, task)
+	api.registry.Own(promptID, host, api)
+	return task
+}
 
-	// 3️⃣ 注册等待 channel
-	ch := make(chan []model.Address, 1)
-	api.waiting.Store(prompt_id, ch)
+// AdoptPending 接管另一个 APIRuntime 中等待结果的任务与网关队列（热重载）
+func (api *APIRuntime) AdoptPending(old *APIRuntime) {
+	api.queue = old.queue
+	count := 0
+	old.waiting.Range(func(key, value interface{}) bool {
+		api.waiting.Store(key, value)
+		api.registry.Own(key.(string), value.(*PromptTask).Host, api)
+		old.waiting.Delete(key)
+		count++
+		return true
+	})
+	if count > 0 {
+		LogAPIRuntime("♻️ 热重载接管 %d 个等待中的任务", count)
+	}
+}
 
-	// 4️⃣ 等待 NotifyTaskDone 回调写入结果
+// Wait 等待 NotifyTaskDone 回调写入结果，超时时间由 API 配置的 timeout 决定，结果按输出节点分组
+func (api *APIRuntime) Wait(task *PromptTask) ([]model.NodeOutput, error) {
 	select {
-	case addresses := <-ch:
-		LogAPIRuntime(ColorYellow+"[GenerateSync] 任务完成，获取地址列表,prompt_id=%s", prompt_id)
-		urls_from_comfyui := address2urls(addresses, target_server)
-		return urls_from_comfyui, prompt_id, nil // ✅ 返回 prompt_id
-	case <-time.After(time.Second * 60):
-		LogAPIRuntime("[GenerateSync] 等待超时，任务结果未收到")
-		return nil, prompt_id, fmt.Errorf("等待超时，任务结果未收到")
+	case result := <-task.done:
+		if result.err != nil {
+			return nil, result.err
+		}
+		LogAPIRuntime(ColorYellow+"[GenerateSync] 任务完成，获取地址列表,prompt_id=%s", task.PromptID)
+		outputs := make([]model.NodeOutput, 0, len(result.outputs))
+		for _, output := range result.outputs {
+			outputs = append(outputs, model.NodeOutput{
+				NodeID: output.nodeID,
+				Title:  api.apiparser.GetNodeTitle(output.nodeID),
+				URLs:   address2urls(output.addresses, task.Host),
+			})
+		}
+		return outputs, nil
+	case <-time.After(api.apiparser.GetTimeout()):
+		LogAPIRuntime("[GenerateSync] 等待超时，任务结果未收到，取消节点上的任务 prompt_id=%s", task.PromptID)
+		// 先从节点队列删除或中断，再释放网关容量，避免超时的任务继续占用节点
+		if err := api.Cancel(task.PromptID); err != nil {
+			LogAPIRuntime(ColorYellow+"[GenerateSync] 取消超时任务失败: %s", err)
+		}
+		return nil, ErrWaitTimeout
 	}
 }
 
-// 辅助函数 address2urls 将地址转换为url,仅支持输出文件
+// 辅助函数 address2urls 将地址转换为url
 func address2urls(addresses []model.Address, host string) []string {
 	urls := make([]string, len(addresses))
 	for i, address := range addresses {
-		url := fmt.Sprintf("%s/view?filename=%s&subfolder=%s&type=output", host, address.Filename, address.Subfolder)
-		urls[i] = url
+		fileType := address.Type
+		if fileType == "" {
+			fileType = "output"
+		}
+		urls[i] = fmt.Sprintf("%s/view?filename=%s&subfolder=%s&type=%s",
+			host, url.QueryEscape(address.Filename), url.QueryEscape(address.Subfolder), fileType)
 	}
 	return urls
 }
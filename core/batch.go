@@ -0,0 +1,124 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"farshore.ai/fast-comfy-api/config"
+	"farshore.ai/fast-comfy-api/model"
+)
+
+/*
+
+批量生成
+
+一次请求提交多组变量，每一组都登记为独立的 Job，
+按有限并发分发到 API 配置的多个 ComfyUI 节点，结果按输入顺序返回
+单条失败不影响其他条目
+*/
+
+// BatchRequest 批量生成请求
+type BatchRequest struct {
+	Token       string                   // API Token
+	Items       []map[string]interface{} // 每一条的替换变量
+	Concurrency int                      // 并发数，<=0 时默认等于节点数
+	Priority    int                      // 排队优先级，作用于所有条目
+}
+
+// BatchItemResult 单条生成结果
+type BatchItemResult struct {
+	Index       int                `json:"index"` // 在输入中的下标
+	JobID       string             `json:"job_id,omitempty"`
+	PromptID    string             `json:"prompt_id,omitempty"`
+	Node        string             `json:"node,omitempty"`
+	NodesTried  []string           `json:"nodes_tried,omitempty"`
+	State       JobState           `json:"state"`
+	URLs        []string           `json:"urls,omitempty"`
+	Outputs     []model.NodeOutput `json:"outputs,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	ErrorDetail *ExecutionError    `json:"error_detail,omitempty"`
+}
+
+// GenerateBatch 批量同步生成，ctx 结束时取消所有未完成的条目
+func (api_manager *APIManager) GenerateBatch(ctx context.Context, req BatchRequest) ([]BatchItemResult, error) {
+	apiruntime, ok := api_manager.getAPI(req.Token)
+	if !ok {
+		return nil, fmt.Errorf("api token %s not found", req.Token)
+	}
+	if len(req.Items) == 0 {
+		return nil, fmt.Errorf("batch items is empty")
+	}
+	if len(req.Items) > config.BatchMaxItems {
+		return nil, fmt.Errorf("batch items exceeds limit %d", config.BatchMaxItems)
+	}
+
+	// 并发数默认等于节点数，让每个节点同时只承担一条
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = len(apiruntime.nodes)
+	}
+	if concurrency > config.BatchMaxConcurrency {
+		concurrency = config.BatchMaxConcurrency
+	}
+	if concurrency > len(req.Items) {
+		concurrency = len(req.Items)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	LogAPIRuntime("[GenerateBatch] API: %s, 条目数: %d, 并发数: %d", apiruntime.GetName(), len(req.Items), concurrency)
+
+	results := make([]BatchItemResult, len(req.Items))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, vars := range req.Items {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			// 调用方已断开，剩余条目不再提交
+			for j := i; j < len(req.Items); j++ {
+				results[j] = BatchItemResult{Index: j, State: JobCancelled, Error: ctx.Err().Error()}
+			}
+			wg.Wait()
+			return results, ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(index int, vars map[string]interface{}) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			job, err := api_manager.GenerateSync(ctx, GenerateRequest{Token: req.Token, Vars: vars, Priority: req.Priority})
+			results[index] = newBatchItemResult(index, job, err)
+		}(i, vars)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// newBatchItemResult 将任务快照转换为批量结果
+func newBatchItemResult(index int, job Job, err error) BatchItemResult {
+	result := BatchItemResult{
+		Index:       index,
+		JobID:       job.ID,
+		PromptID:    job.PromptID,
+		Node:        job.Node,
+		NodesTried:  job.Tried,
+		State:       job.State,
+		URLs:        job.URLs,
+		Outputs:     job.Outputs,
+		ErrorDetail: job.ErrorInfo,
+	}
+	if err != nil {
+		result.Error = err.Error()
+		switch {
+		case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+			result.State = JobCancelled
+		case !result.State.IsFinished():
+			result.State = JobFailed
+		}
+	}
+	return result
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+
+任务进度事件总线
+
+MessageWorker 解析 ComfyUI 的进度消息 -> APIRuntime 计算整体进度 -> APIManager 按 job_id 发布
+SSE 接口订阅某个 job_id 的事件并转发给前端
+*/
+
+// 进度事件类型
+const (
+	EventJobState        = "job_state"        // 任务状态变化 queued/running/uploading/succeeded/failed
+	EventExecuting       = "executing"        // 节点开始执行
+	EventProgress        = "progress"         // 节点内部步数进度 value/max
+	EventExecutionCached = "execution_cached" // 命中缓存的节点
+	EventProgressState   = "progress_state"   // 所有节点的进度快照
+)
+
+// ProgressEvent 进度事件
+type ProgressEvent struct {
+	Type     string    `json:"type"`
+	JobID    string    `json:"job_id,omitempty"`
+	PromptID string    `json:"prompt_id"`
+	State    JobState  `json:"state,omitempty"` // job_state 事件的任务状态
+	Node     string    `json:"node,omitempty"`  // 当前节点 ID
+	Nodes    []string  `json:"nodes,omitempty"` // 命中缓存 / 已完成的节点
+	Value    int       `json:"value,omitempty"` // 当前节点步数
+	Max      int       `json:"max,omitempty"`   // 当前节点总步数
+	Percent  float64   `json:"percent"`         // 整体进度百分比
+	Error    string    `json:"error,omitempty"` // 任务失败原因
+	Time     time.Time `json:"time"`
+}
+
+// NewJobStateEvent 根据任务快照构造状态事件
+func NewJobStateEvent(job Job) ProgressEvent {
+	event := ProgressEvent{
+		Type:     EventJobState,
+		JobID:    job.ID,
+		PromptID: job.PromptID,
+		State:    job.State,
+		Error:    job.Error,
+		Time:     time.Now(),
+	}
+	if job.State == JobUploading || job.State == JobSucceeded {
+		event.Percent = 100
+	}
+	return event
+}
+
+// EventBus 按 job_id 分发进度事件
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[string]map[chan ProgressEvent]struct{} // job_id -> 订阅者
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: make(map[string]map[chan ProgressEvent]struct{}),
+	}
+}
+
+// Subscribe 订阅某个任务的事件，返回事件通道以及取消订阅函数
+func (b *EventBus) Subscribe(jobID string) (<-chan ProgressEvent, func()) {
+	ch := make(chan ProgressEvent, 64)
+
+	b.mu.Lock()
+	if b.subs[jobID] == nil {
+		b.subs[jobID] = make(map[chan ProgressEvent]struct{})
+	}
+	b.subs[jobID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[jobID], ch)
+		if len(b.subs[jobID]) == 0 {
+			delete(b.subs, jobID)
+		}
+	}
+	return ch, cancel
+}
+
+// Publish 发布事件，订阅者处理不过来时丢弃，避免阻塞消息消费
+func (b *EventBus) Publish(event ProgressEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subs[event.JobID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// promptProgress 记录单个 prompt 的节点完成情况，用于计算整体进度
+type promptProgress struct {
+	mu      sync.Mutex
+	total   int             // prompt 节点总数
+	done    map[string]bool // 已完成（或命中缓存）的节点
+	current string          // 当前执行的节点
+	value   int
+	max     int
+}
+
+func newPromptProgress(total int) *promptProgress {
+	return &promptProgress{
+		total: total,
+		done:  make(map[string]bool),
+	}
+}
+
+// apply 根据事件更新进度，并写入 event.Percent
+func (p *promptProgress) apply(event *ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch event.Type {
+	case EventExecuting:
+		if p.current != "" {
+			p.done[p.current] = true
+		}
+		p.current, p.value, p.max = event.Node, 0, 0
+		if event.Node == "" {
+			// node 为 null 表示整个 prompt 执行完毕
+			event.Percent = 100
+			return
+		}
+	case EventExecutionCached:
+		for _, node := range event.Nodes {
+			p.done[node] = true
+		}
+	case EventProgress:
+		if event.Node != p.current && p.current != "" {
+			p.done[p.current] = true
+		}
+		p.current, p.value, p.max = event.Node, event.Value, event.Max
+	case EventProgressState:
+		// progress_state 事件中 Nodes 为已完成的节点，Node 为正在执行的节点
+		for _, node := range event.Nodes {
+			p.done[node] = true
+		}
+		if event.Node != "" {
+			p.current, p.value, p.max = event.Node, event.Value, event.Max
+		}
+	}
+
+	event.Percent = p.percent()
+}
+
+func (p *promptProgress) percent() float64 {
+	if p.total <= 0 {
+		return 0
+	}
+	finished := float64(len(p.done))
+	if p.current != "" && !p.done[p.current] && p.max > 0 {
+		finished += float64(p.value) / float64(p.max)
+	}
+	percent := finished / float64(p.total) * 100
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
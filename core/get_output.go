@@ -9,55 +9,145 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+
+	"farshore.ai/fast-comfy-api/model"
 )
 
-type HistoryResponse map[string]struct {
-	Outputs map[string]struct {
-		Images []struct {
-			Filename  string `json:"filename"`
-			Subfolder string `json:"subfolder"`
-			Type      string `json:"type"`
-		} `json:"images"`
-	} `json:"outputs"`
+// HistoryResponse /history/{prompt_id} 返回结构
+type HistoryResponse map[string]HistoryEntry
+
+// HistoryEntry 单个 prompt 的执行记录
+type HistoryEntry struct {
+	// 节点 ID -> 输出（images / audio / videos / gifs ...）
+	Outputs map[string]map[string]json.RawMessage `json:"outputs"`
+	Status  struct {
+		StatusStr string              `json:"status_str"` // success / error
+		Completed bool                `json:"completed"`
+		Messages  [][]json.RawMessage `json:"messages"` // [消息类型, 消息内容]
+	} `json:"status"`
 }
 
-// GetFinalOutputImages 根据 prompt_id 获取最终 output 类型图片的访问 URL
-func GetOutputURLs(host, promptID string) ([]string, error) {
+// historyFile 输出文件
+type historyFile struct {
+	Filename  string `json:"filename"`
+	Subfolder string `json:"subfolder"`
+	Type      string `json:"type"`
+}
+
+// GetHistory 获取 prompt 的执行记录，尚未执行完毕时 found 为 false
+func GetHistory(host, promptID string) (entry HistoryEntry, found bool, err error) {
 	url := fmt.Sprintf("%s/history/%s", host, promptID)
 	resp, err := http.Get(url)
 	if err != nil {
-		return nil, fmt.Errorf("请求 history 接口失败: %v", err)
+		return entry, false, fmt.Errorf("请求 history 接口失败: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("history 接口返回状态码 %d", resp.StatusCode)
+		return entry, false, fmt.Errorf("history 接口返回状态码 %d", resp.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("读取 history 响应失败: %v", err)
+		return entry, false, fmt.Errorf("读取 history 响应失败: %v", err)
 	}
 
 	var history HistoryResponse
 	if err := json.Unmarshal(body, &history); err != nil {
-		return nil, fmt.Errorf("解析 JSON 失败: %v", err)
+		return entry, false, fmt.Errorf("解析 JSON 失败: %v", err)
 	}
 
-	task, ok := history[promptID]
-	if !ok {
-		return nil, fmt.Errorf("history 中未找到 prompt_id: %s", promptID)
+	entry, found = history[promptID]
+	return entry, found, nil
+}
+
+// OutputAddresses 按节点 ID 顺序返回所有 output 类型的文件地址
+func (e HistoryEntry) OutputAddresses() ([]string, map[string][]model.Address) {
+	nodeIDs := make([]string, 0, len(e.Outputs))
+	result := make(map[string][]model.Address)
+	for nodeID, output := range e.Outputs {
+		for _, raw := range output {
+			var files []historyFile
+			if err := json.Unmarshal(raw, &files); err != nil {
+				continue // 非文件列表（如文本输出）
+			}
+			for _, file := range files {
+				if file.Filename == "" || file.Type != "output" { // 只取最终 output 类型
+					continue
+				}
+				result[nodeID] = append(result[nodeID], model.Address{
+					Subfolder: file.Subfolder,
+					Filename:  file.Filename,
+					Type:      file.Type,
+				})
+			}
+		}
+		if len(result[nodeID]) > 0 {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
 	}
+	sort.Strings(nodeIDs)
+	return nodeIDs, result
+}
 
-	var urls []string
-	for _, output := range task.Outputs {
-		for _, img := range output.Images {
-			if img.Type == "output" { // 只取最终 output 类型
-				url := fmt.Sprintf("%s/view?filename=%s&subfolder=%s&type=%s", host, img.Filename, img.Subfolder, img.Type)
-				urls = append(urls, url)
+// ExecutionError 从执行记录的消息中还原失败信息，未失败时返回 nil
+func (e HistoryEntry) ExecutionError(promptID string) *ExecutionError {
+	if e.Status.StatusStr != "error" {
+		return nil
+	}
+	for _, message := range e.Status.Messages {
+		if len(message) != 2 {
+			continue
+		}
+		var msgType string
+		if err := json.Unmarshal(message[0], &msgType); err != nil {
+			continue
+		}
+		switch msgType {
+		case "execution_error":
+			var data ExecutionErrorData
+			if err := json.Unmarshal(message[1], &data); err == nil {
+				return &ExecutionError{
+					PromptID:         promptID,
+					NodeID:           data.NodeID,
+					NodeType:         data.NodeType,
+					ExceptionType:    data.ExceptionType,
+					ExceptionMessage: data.ExceptionMessage,
+					Traceback:        data.Traceback,
+				}
+			}
+		case "execution_interrupted":
+			var data ExecutionInterruptedData
+			if err := json.Unmarshal(message[1], &data); err == nil {
+				return &ExecutionError{
+					PromptID:         promptID,
+					NodeID:           data.NodeID,
+					NodeType:         data.NodeType,
+					ExceptionMessage: "execution interrupted",
+					Interrupted:      true,
+				}
 			}
 		}
 	}
+	return &ExecutionError{PromptID: promptID, ExceptionMessage: "execution failed"}
+}
+
+// GetFinalOutputImages 根据 prompt_id 获取最终 output 类型文件的访问 URL
+func GetOutputURLs(host, promptID string) ([]string, error) {
+	entry, found, err := GetHistory(host, promptID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("history 中未找到 prompt_id: %s", promptID)
+	}
+
+	var urls []string
+	nodeIDs, addresses := entry.OutputAddresses()
+	for _, nodeID := range nodeIDs {
+		urls = append(urls, address2urls(addresses[nodeID], host)...)
+	}
 
 	return urls, nil
 }
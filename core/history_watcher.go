@@ -0,0 +1,126 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"farshore.ai/fast-comfy-api/config"
+)
+
+/*
+
+/history 轮询兜底
+
+WebSocket 重连、msgChan 满导致消息被丢弃时，任务的完成事件可能永远收不到。
+watchPending 定期检查等待中的任务，超过 config.HistoryPollGrace 秒没有收到任何事件时：
+1. 任务仍在节点队列中（执行中 / 排队中）-> 继续等待
+2. /history 中已有记录 -> 按记录完成或失败
+3. 既不在队列也不在历史记录 -> 任务丢失，返回失败
+*/
+
+// ErrTaskLost 任务在节点上丢失（不在队列中，也没有历史记录）
+var ErrTaskLost = errors.New("任务在节点上丢失")
+
+// ErrNodeLost 任务执行中节点失联（WebSocket 断开且节点不可达）
+var ErrNodeLost = errors.New("节点失联")
+
+// IsNodeFailure 是否为节点故障导致的失败，可按重试策略转移到其他节点
+func IsNodeFailure(err error) bool {
+	return errors.Is(err, ErrTaskLost) || errors.Is(err, ErrNodeLost)
+}
+
+// touch 记录最近一次收到事件的时间
+func (t *PromptTask) touch() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastEvent = time.Now()
+}
+
+// idleFor 距离最近一次事件的时长
+func (t *PromptTask) idleFor() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Since(t.lastEvent)
+}
+
+// watchPending 定期对账长时间没有事件的任务
+func (api *APIRuntime) watchPending(stopCh chan struct{}) {
+	ticker := time.NewTicker(config.HistoryPollInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			api.waiting.Range(func(_, value interface{}) bool {
+				task := value.(*PromptTask)
+				if task.idleFor() >= config.HistoryPollGrace*time.Second {
+					go api.reconcileTask(task, false)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// reconcileTask 通过 /queue 与 /history 对账单个任务
+// nodeDown 为 true 表示节点 WebSocket 已断开，此时节点不可达视为节点失联
+func (api *APIRuntime) reconcileTask(task *PromptTask, nodeDown bool) {
+	task.touch() // 避免下一个周期重复对账
+
+	// 1️⃣ 先查队列：ComfyUI 先写入历史记录再移出队列，按此顺序查询不会误判丢失
+	running, pending, err := GetComfyuiQueue(task.Host)
+	if err != nil {
+		LogAPIRuntime(ColorYellow+"[History] 获取节点队列失败 host=%s: %s", task.Host, err)
+		if nodeDown {
+			api.finishTask(task.PromptID, taskResult{err: fmt.Errorf("%w: %s prompt_id=%s: %v", ErrNodeLost, task.Host, task.PromptID, err)})
+		}
+		return
+	}
+	if slices.Contains(running, task.PromptID) || slices.Contains(pending, task.PromptID) {
+		return
+	}
+
+	// 2️⃣ 再查历史记录
+	entry, found, err := GetHistory(task.Host, task.PromptID)
+	if err != nil {
+		LogAPIRuntime(ColorYellow+"[History] 获取历史记录失败 prompt_id=%s: %s", task.PromptID, err)
+		return
+	}
+	if !found {
+		LogAPIRuntime(ColorRed+"[History] 任务丢失 prompt_id=%s host=%s", task.PromptID, task.Host)
+		api.finishTask(task.PromptID, taskResult{err: fmt.Errorf("%w: %s prompt_id=%s", ErrTaskLost, task.Host, task.PromptID)})
+		return
+	}
+
+	if execErr := entry.ExecutionError(task.PromptID); execErr != nil {
+		LogAPIRuntime(ColorRed+"[History] 通过历史记录确认任务失败 prompt_id=%s: %s", task.PromptID, execErr)
+		api.finishTask(task.PromptID, taskResult{err: execErr})
+		return
+	}
+	LogAPIRuntime(ColorYellow+"[History] 通过历史记录确认任务完成 prompt_id=%s", task.PromptID)
+	api.finishTask(task.PromptID, taskResult{outputs: historyOutputs(entry)})
+}
+
+// fetchHistoryOutputs executed 消息丢失（或全部命中缓存）时，从 /history 补全结果后完成任务
+// 查询失败时任务留在等待列表中，由 watchPending 稍后对账（找不到记录时按任务丢失处理，可故障转移），不能以空结果视为成功
+func (api *APIRuntime) fetchHistoryOutputs(task *PromptTask) {
+	entry, found, err := GetHistory(task.Host, task.PromptID)
+	if err != nil || !found {
+		LogAPIRuntime(ColorYellow+"[History] 补全结果失败，等待对账 prompt_id=%s found=%v err=%v", task.PromptID, found, err)
+		return
+	}
+	api.finishTask(task.PromptID, taskResult{outputs: historyOutputs(entry)})
+}
+
+// historyOutputs 将历史记录中的输出转换为按节点分组的结果
+func historyOutputs(entry HistoryEntry) []*nodeAddresses {
+	nodeIDs, addresses := entry.OutputAddresses()
+	outputs := make([]*nodeAddresses, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		outputs = append(outputs, &nodeAddresses{nodeID: nodeID, addresses: addresses[nodeID]})
+	}
+	return outputs
+}
@@ -0,0 +1,431 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"farshore.ai/fast-comfy-api/config"
+	"farshore.ai/fast-comfy-api/model"
+	"github.com/google/uuid"
+)
+
+/*
+
+文件类型变量
+
+type 为 image 的变量对应 LoadImage 等节点 input 目录中的文件名。
+调用方通过 multipart 上传文件，网关先暂存在内存中，GetBestServer 选出节点后：
+1. 把文件上传到该节点的 POST /upload/image（文件名改为 uuid，避免不同请求互相覆盖）
+2. 将返回的文件名（有 subfolder 时为 subfolder/name）替换到变量的 path
+3. 提交 prompt
+故障转移换节点时在新节点上重新上传
+
+没有上传文件时，变量按字符串处理：传入的值或 default 视为节点上已存在的文件名
+
+image_url / audio_url / video_url 类型的变量传入 http(s) 地址，入队前由 URLFetcher 下载，之后与上传的文件相同
+audio / video 类型的变量（LoadAudio、VHS_LoadVideo 等）同时接受上传的文件与 http(s) 地址，并限制时长（见 media_duration.go）
+
+只能发送 JSON 的调用方可以在 vars 中直接传入 data URI（data:image/png;base64,...）或 base64 字符串，
+入队前解码；上传、下载、解码的文件类型都以文件头为准（detectDataContentType），与变量类型不符时拒绝；解码后的大小上限可以在 API 配置中通过 max_base64_size 调整
+不带 data: 前缀时，只有长度不少于 config.InlineBase64MinLength 且全部为 base64 字符的值才按 base64 解码，否则仍视为文件名
+*/
+
+// 文件类型变量
+const (
+	VariableTypeImage    = "image"
+	VariableTypeMask     = "mask"
+	VariableTypeAudio    = "audio"
+	VariableTypeVideo    = "video"
+	VariableTypeImageURL = "image_url"
+	VariableTypeAudioURL = "audio_url"
+	VariableTypeVideoURL = "video_url"
+)
+
+// InputFile 调用方上传的文件
+type InputFile struct {
+	Filename    string // 原始文件名
+	ContentType string // 识别出的文件类型
+	Data        []byte
+
+	original string // mask 对应的图片未上传时，图片在节点 input 目录中的文件名
+}
+
+// NewInputFile 读取上传的文件并识别类型，超过 config.InputFileMaxSize 时报错
+func NewInputFile(filename string, r io.Reader) (InputFile, error) {
+	data, err := io.ReadAll(io.LimitReader(r, config.InputFileMaxSize<<20+1))
+	if err != nil {
+		return InputFile{}, err
+	}
+	if len(data) > config.InputFileMaxSize<<20 {
+		return InputFile{}, fmt.Errorf("文件超过 %d MB", config.InputFileMaxSize)
+	}
+	return InputFile{
+		Filename:    filename,
+		ContentType: detectDataContentType(filename, data),
+		Data:        data,
+	}, nil
+}
+
+// IsFileVariableType 是否为接受上传文件的变量类型
+func IsFileVariableType(varType string) bool {
+	switch varType {
+	case VariableTypeImage, VariableTypeMask, VariableTypeAudio, VariableTypeVideo:
+		return true
+	}
+	return false
+}
+
+// IsURLVariableType 是否为远程 URL 输入的变量类型
+func IsURLVariableType(varType string) bool {
+	switch varType {
+	case VariableTypeImageURL, VariableTypeAudioURL, VariableTypeVideoURL:
+		return true
+	}
+	return false
+}
+
+// inputMedia 文件类型变量对应的媒体类型（MIME 前缀）与大小上限（MB）
+func inputMedia(varType string) (media string, maxSize int) {
+	switch varType {
+	case VariableTypeImage, VariableTypeImageURL, VariableTypeMask:
+		return "image", config.InputImageMaxSize
+	case VariableTypeAudio, VariableTypeAudioURL:
+		return "audio", config.InputAudioMaxSize
+	case VariableTypeVideo, VariableTypeVideoURL:
+		return "video", config.InputVideoMaxSize
+	}
+	return "", 0
+}
+
+// inputMaxDuration 音视频的时长上限
+func inputMaxDuration(media string) time.Duration {
+	switch media {
+	case "audio":
+		return config.InputAudioMaxDuration * time.Second
+	case "video":
+		return config.InputVideoMaxDuration * time.Second
+	}
+	return 0
+}
+
+// matchMedia 文件类型是否属于 media；只含音轨的 MP4 / WebM / OGG 识别出的类型与视频相同，音频也接受
+func matchMedia(contentType string, media string) bool {
+	if strings.HasPrefix(contentType, media+"/") {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch media {
+	case "audio":
+		return mediaType == "application/ogg" || mediaType == "video/mp4" || mediaType == "video/webm"
+	case "video":
+		return mediaType == "application/ogg"
+	}
+	return false
+}
+
+// checkInputFile 校验文件大小与类型
+func checkInputFile(file InputFile, media string, maxSize int) error {
+	if len(file.Data) == 0 {
+		return errors.New("文件为空")
+	}
+	if len(file.Data) > maxSize<<20 {
+		return fmt.Errorf("文件超过 %d MB", maxSize)
+	}
+	if !matchMedia(file.ContentType, media) {
+		return fmt.Errorf("文件类型应为 %s，实际是 %s", media, file.ContentType)
+	}
+	if limit := inputMaxDuration(media); limit > 0 {
+		duration, ok := mediaDuration(file.Data)
+		if !ok {
+			LogAPIRuntime(ColorYellow+"[checkInputFile] 无法解析 %s 的时长，跳过时长限制", file.Filename)
+		} else if duration > limit {
+			return fmt.Errorf("时长 %s 超过上限 %s", duration.Round(time.Second), limit)
+		}
+	}
+	return nil
+}
+
+// CheckInputFiles 校验上传的文件：变量已定义且为文件类型，文件类型与大小符合要求
+func (p *APIParser) CheckInputFiles(files map[string]InputFile) error {
+	for name, file := range files {
+		def, ok := p.GetVariable(name)
+		if !ok {
+			return fmt.Errorf("变量 '%s' 未定义", name)
+		}
+		if !IsFileVariableType(def.Type) {
+			return fmt.Errorf("变量 '%s' 类型为 %s，不接受文件", name, def.Type)
+		}
+		media, maxSize := inputMedia(def.Type)
+		if err := checkInputFile(file, media, maxSize); err != nil {
+			return fmt.Errorf("变量 '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// resolveInputs 解码 data URI / base64、下载 URL 类型变量的文件，与上传的文件合并，失败时返回具体的变量
+func (api *APIRuntime) resolveInputs(vars map[string]interface{}, files map[string]InputFile) (map[string]InputFile, error) {
+	for _, name := range api.apiparser.GetVariableNames() {
+		def, _ := api.apiparser.GetVariable(name)
+		media, maxSize := inputMedia(def.Type)
+		if media == "" {
+			continue
+		}
+		if _, uploaded := files[name]; uploaded {
+			continue
+		}
+		val, exists := vars[name]
+		if !exists {
+			val = def.Default
+		}
+		value, _ := val.(string)
+
+		var file InputFile
+		switch {
+		case IsFileVariableType(def.Type) && isInlineData(value):
+			if limit := api.apiparser.GetMaxBase64Size(); limit > 0 {
+				maxSize = limit
+			}
+			decoded, err := decodeInlineInput(name, value, media, maxSize)
+			if err != nil {
+				return nil, fmt.Errorf("变量 '%s' 解码失败: %w", name, err)
+			}
+			file = decoded
+			LogAPIRuntime("[resolveInputs] 变量 %s 解码完成 (%s, %d bytes)", name, file.ContentType, len(file.Data))
+		case IsURLVariableType(def.Type) || (isRemoteURL(value) && (media == "audio" || media == "video")):
+			if value == "" {
+				return nil, fmt.Errorf("变量 '%s' 缺少 URL", name)
+			}
+			fetched, err := api.fetcher.Fetch(context.Background(), value, media, maxSize)
+			if err != nil {
+				return nil, fmt.Errorf("变量 '%s' 下载失败: %w", name, err)
+			}
+			file = fetched
+			LogAPIRuntime("[resolveInputs] 变量 %s 下载完成: %s (%s, %d bytes)", name, value, file.ContentType, len(file.Data))
+		default:
+			// 节点 input 目录中已有的文件名
+			continue
+		}
+		if files == nil {
+			files = make(map[string]InputFile)
+		}
+		files[name] = file
+	}
+	return files, nil
+}
+
+// isRemoteURL 是否为 http(s) 地址，audio / video 变量传入地址时下载
+func isRemoteURL(value string) bool {
+	return strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://")
+}
+
+// isInlineData 是否为 data URI 或 base64 编码的文件内容
+func isInlineData(value string) bool {
+	if strings.HasPrefix(value, "data:") {
+		return true
+	}
+	if len(value) < config.InlineBase64MinLength {
+		return false
+	}
+	for _, ch := range value {
+		switch {
+		case ch >= 'A' && ch <= 'Z', ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9':
+		case ch == '+', ch == '/', ch == '-', ch == '_', ch == '=', ch == '\n', ch == '\r':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// decodeInlineInput 解码 data URI 或 base64 字符串，并校验类型与大小（maxSize 单位 MB）
+func decodeInlineInput(name string, value string, media string, maxSize int) (InputFile, error) {
+	encoded := value
+	if strings.HasPrefix(value, "data:") {
+		// data:[<mediatype>][;base64],<data>，声明的类型不可信，仍按文件头识别
+		header, payload, ok := strings.Cut(value, ",")
+		if !ok || !strings.HasSuffix(header, ";base64") {
+			return InputFile{}, errors.New("只支持 base64 编码的 data URI")
+		}
+		encoded = payload
+	}
+	encoded = strings.TrimRight(strings.NewReplacer("\n", "", "\r", "").Replace(encoded), "=")
+	if base64.RawStdEncoding.DecodedLen(len(encoded)) > maxSize<<20 {
+		return InputFile{}, fmt.Errorf("文件超过 %d MB", maxSize)
+	}
+	encoding := base64.RawStdEncoding
+	if strings.ContainsAny(encoded, "-_") {
+		encoding = base64.RawURLEncoding
+	}
+	data, err := encoding.DecodeString(encoded)
+	if err != nil {
+		return InputFile{}, fmt.Errorf("invalid base64: %w", err)
+	}
+
+	contentType := detectDataContentType(name, data)
+	file := InputFile{Filename: name + fileExtension(contentType), ContentType: contentType, Data: data}
+	if err := checkInputFile(file, media, maxSize); err != nil {
+		return InputFile{}, err
+	}
+	return file, nil
+}
+
+// fileExtension 按文件类型选择扩展名，节点上的加载器依赖扩展名识别文件
+func fileExtension(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "image/jpeg":
+		return ".jpg"
+	case "audio/mpeg":
+		return ".mp3"
+	case "audio/wave":
+		return ".wav"
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// omitInlineData 任务日志中不保存文件类型变量的 data URI / base64 内容，只记录长度
+func (p *APIParser) omitInlineData(vars map[string]interface{}) map[string]interface{} {
+	var result map[string]interface{}
+	for key, val := range vars {
+		def, ok := p.GetVariable(key)
+		if !ok || !IsFileVariableType(def.Type) {
+			continue
+		}
+		if value, ok := val.(string); ok && isInlineData(value) {
+			if result == nil {
+				result = maps.Clone(vars)
+			}
+			result[key] = fmt.Sprintf("<inline data, %d chars>", len(value))
+		}
+	}
+	if result == nil {
+		return vars
+	}
+	return result
+}
+
+// uploadInputs 把文件上传到节点，并将节点上的文件名替换到 prompt 中变量的 path
+// mask 需要引用图片在节点上的文件名，因此在其他文件之后上传
+func (api *APIRuntime) uploadInputs(host string, prompt map[string]model.PromptNode, files map[string]InputFile) error {
+	stored := make(map[string]string, len(files))
+	for _, masks := range []bool{false, true} {
+		for name, file := range files {
+			def, _ := api.apiparser.GetVariable(name)
+			if (def.Type == VariableTypeMask) != masks {
+				continue
+			}
+			var err error
+			if masks {
+				original, ok := stored[def.Original]
+				if !ok {
+					original = file.original
+				}
+				stored[name], err = UploadMask(host, file, original)
+			} else {
+				stored[name], err = UploadImage(host, file)
+			}
+			if err != nil {
+				return fmt.Errorf("变量 '%s' 上传到节点失败: %w", name, err)
+			}
+			if err := setPromptInput(prompt, api.apiparser.GetVariablePath(name), stored[name]); err != nil {
+				return fmt.Errorf("变量 '%s': %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setPromptInput 按 "节点ID.inputs.参数名" 设置 prompt 中的值
+func setPromptInput(prompt map[string]model.PromptNode, path string, value interface{}) error {
+	parts := strings.Split(path, ".")
+	if len(parts) < 3 || parts[1] != "inputs" {
+		return fmt.Errorf("路径格式错误，应为: 节点ID.inputs.参数名: %s", path)
+	}
+	node, ok := prompt[parts[0]]
+	if !ok {
+		return fmt.Errorf("未找到节点ID: %s", parts[0])
+	}
+	node.Inputs[parts[2]] = value
+	return nil
+}
+
+// UploadImageResponse ComfyUI POST /upload/image 返回结构
+type UploadImageResponse struct {
+	Name      string `json:"name"`
+	Subfolder string `json:"subfolder"`
+	Type      string `json:"type"`
+}
+
+// UploadImage 上传文件到节点的 input 目录，返回 prompt 中引用的文件名
+func UploadImage(host string, file InputFile) (string, error) {
+	return uploadInput(host, "/upload/image", file, nil)
+}
+
+// uploadInput 以 multipart 上传文件到节点，fields 为额外的表单字段
+func uploadInput(host string, endpoint string, file InputFile, fields map[string]string) (string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	name := strings.ReplaceAll(uuid.NewString(), "-", "") + strings.ToLower(filepath.Ext(file.Filename))
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="image"; filename="%s"`, name))
+	header.Set("Content-Type", file.ContentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(file.Data); err != nil {
+		return "", err
+	}
+	writer.WriteField("type", "input")
+	writer.WriteField("overwrite", "false")
+	for key, value := range fields {
+		writer.WriteField(key, value)
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	fullURL := strings.TrimRight(host, "/") + endpoint
+	client := &http.Client{Timeout: config.InputUploadTimeout * time.Second}
+	resp, err := client.Post(fullURL, writer.FormDataContentType(), body)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to upload %s: %s", endpoint, string(respBody))
+	}
+
+	var result UploadImageResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	LogAPIRuntime("[uploadInput] 上传到 %s%s: %s (%d bytes)", host, endpoint, result.Name, len(file.Data))
+	if result.Subfolder != "" {
+		return result.Subfolder + "/" + result.Name, nil
+	}
+	return result.Name, nil
+}
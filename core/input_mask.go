@@ -0,0 +1,114 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strings"
+)
+
+/*
+
+遮罩（mask）变量
+
+局部重绘工作流使用 LoadImage 的 MASK 输出，ComfyUI 从图片的 alpha 通道读取遮罩（透明处为重绘区域）。
+mask 类型变量通过 original 指向配对的 image 变量，上传时走节点的 POST /upload/mask：
+ComfyUI 读取上传文件的 alpha 通道，写入 original_ref 指向的图片，另存为新文件，
+网关把新文件名写入 mask 变量的 path（通常与 image 变量相同，即 LoadImage 的 image 输入）
+
+遮罩文件的两种形式：
+1. 带透明通道的 PNG（如 ComfyUI 遮罩编辑器导出），原样上传
+2. 不透明的灰度图（白色为重绘区域），网关转换为 alpha 通道后再上传
+*/
+
+// prepareMasks 把灰度遮罩转换为 alpha 遮罩，校验与配对图片的尺寸，并记录未上传图片时的原图文件名
+func (api *APIRuntime) prepareMasks(vars map[string]interface{}, files map[string]InputFile) error {
+	for name, file := range files {
+		def, _ := api.apiparser.GetVariable(name)
+		if def.Type != VariableTypeMask {
+			continue
+		}
+		mask, err := toAlphaMask(file)
+		if err != nil {
+			return fmt.Errorf("变量 '%s': %w", name, err)
+		}
+
+		if original, ok := files[def.Original]; ok {
+			// 配对的图片也是上传的，能解码时校验尺寸，否则交给节点校验
+			if size, _, err := image.DecodeConfig(bytes.NewReader(original.Data)); err == nil {
+				if bounds := mask.bounds; bounds.Dx() != size.Width || bounds.Dy() != size.Height {
+					return fmt.Errorf("变量 '%s' 遮罩尺寸 %dx%d 与图片 '%s' 的 %dx%d 不一致",
+						name, bounds.Dx(), bounds.Dy(), def.Original, size.Width, size.Height)
+				}
+			}
+		} else {
+			// 配对的图片是节点上已有的文件
+			originalDef, _ := api.apiparser.GetVariable(def.Original)
+			val, exists := vars[def.Original]
+			if !exists {
+				val = originalDef.Default
+			}
+			filename, _ := val.(string)
+			if filename == "" {
+				return fmt.Errorf("变量 '%s' 缺少对应的图片 '%s'", name, def.Original)
+			}
+			mask.file.original = filename
+		}
+		files[name] = mask.file
+	}
+	return nil
+}
+
+// alphaMask 转换后的遮罩文件
+type alphaMask struct {
+	file   InputFile
+	bounds image.Rectangle
+}
+
+// toAlphaMask 带透明像素的遮罩原样返回；不透明的遮罩按灰度转换为 alpha（白色 -> 透明，即重绘区域）
+func toAlphaMask(file InputFile) (alphaMask, error) {
+	img, _, err := image.Decode(bytes.NewReader(file.Data))
+	if err != nil {
+		return alphaMask{}, fmt.Errorf("遮罩仅支持 PNG / JPEG / GIF: %w", err)
+	}
+	bounds := img.Bounds()
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		return alphaMask{file: file, bounds: bounds}, nil
+	}
+
+	out := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+			out.SetNRGBA(x, y, color.NRGBA{A: 255 - gray.Y})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out); err != nil {
+		return alphaMask{}, err
+	}
+	name := strings.TrimSuffix(file.Filename, filepath.Ext(file.Filename)) + ".png"
+	return alphaMask{
+		file:   InputFile{Filename: name, ContentType: "image/png", Data: buf.Bytes()},
+		bounds: bounds,
+	}, nil
+}
+
+// UploadMask 上传遮罩到节点的 /upload/mask，ComfyUI 将遮罩的 alpha 通道合并到 original 图片并另存，返回新文件名
+func UploadMask(host string, file InputFile, original string) (string, error) {
+	ref := map[string]string{"filename": original, "type": "input"}
+	if i := strings.LastIndex(original, "/"); i >= 0 {
+		ref["subfolder"], ref["filename"] = original[:i], original[i+1:]
+	}
+	refJSON, err := json.Marshal(ref)
+	if err != nil {
+		return "", err
+	}
+	return uploadInput(host, "/upload/mask", file, map[string]string{"original_ref": string(refJSON)})
+}
@@ -0,0 +1,451 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"farshore.ai/fast-comfy-api/config"
+	"farshore.ai/fast-comfy-api/model"
+	"github.com/google/uuid"
+)
+
+/*
+
+任务存储
+
+每一次生成请求（同步 / 异步）都会登记为一个 Job，
+通过 job_id 可以查询任务状态以及最终的 S3 地址
+
+任务日志（journal）：每个任务以 {job_id}.json 的形式落盘到 job_store.dir，
+每次状态变化都会覆盖写入，网关重启后读取未结束的任务并与节点对账
+
+pending -> queued -> running -> uploading -> succeeded
+                                         \-> failed / cancelled
+*/
+
+// JobState 任务状态
+type JobState string
+
+const (
+	JobPending   JobState = "pending"   // 在网关队列中等待节点空闲
+	JobQueued    JobState = "queued"    // 已提交到 ComfyUI，排队中
+	JobRunning   JobState = "running"   // ComfyUI 开始执行
+	JobUploading JobState = "uploading" // 执行完成，正在上传结果到 S3
+	JobSucceeded JobState = "succeeded" // 成功
+	JobFailed    JobState = "failed"    // 失败
+	JobCancelled JobState = "cancelled" // 已取消
+)
+
+// IsFinished 是否为终态
+func (s JobState) IsFinished() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCancelled
+}
+
+// Job 一次生成任务
+type Job struct {
+	ID         string                 `json:"job_id"`
+	Token      string                 `json:"-"`
+	APIName    string                 `json:"api_name"`
+	Vars       map[string]interface{} `json:"-"`
+	Callback   string                 `json:"callback_url,omitempty"` // 任务结束后的回调地址
+	IdemKey    string                 `json:"-"`                      // Idempotency-Key，同一 token 下唯一
+	IdemHash   string                 `json:"-"`                      // 携带 Idempotency-Key 的请求内容摘要，重用 key 时校验请求是否相同
+	Node       string                 `json:"node"`                   // 实际执行的 ComfyUI 节点
+	PromptID   string                 `json:"prompt_id"`              // ComfyUI 返回的 prompt_id
+	Tried      []string               `json:"nodes_tried,omitempty"`  // 已尝试过的节点（故障转移时有多个）
+	State      JobState               `json:"state"`
+	URLs       []string               `json:"urls,omitempty"`         // 最终的 S3 地址
+	Outputs    []model.NodeOutput     `json:"outputs,omitempty"`      // 按输出节点分组的 S3 地址
+	Error      string                 `json:"error,omitempty"`        // 失败原因
+	ErrorInfo  *ExecutionError        `json:"error_detail,omitempty"` // ComfyUI 执行失败详情（节点、异常、traceback）
+	RetryAfter int                    `json:"retry_after,omitempty"`  // 因过载被拒绝时，建议的重试间隔（秒）
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+}
+
+// Err 将未成功的任务还原为 error，执行失败详情可通过 errors.As 取出 *ExecutionError，过载拒绝为 *OverloadError
+func (j Job) Err() error {
+	if j.State == JobSucceeded {
+		return nil
+	}
+	if j.RetryAfter > 0 {
+		return &OverloadError{Reason: j.Error, RetryAfter: time.Duration(j.RetryAfter) * time.Second}
+	}
+	return &jobError{msg: j.Error, detail: j.ErrorInfo}
+}
+
+type jobError struct {
+	msg    string
+	detail *ExecutionError
+}
+
+func (e *jobError) Error() string {
+	return e.msg
+}
+
+func (e *jobError) Unwrap() error {
+	if e.detail == nil {
+		return nil
+	}
+	return e.detail
+}
+
+// jobRecord 落盘格式，额外保存 token 与变量用于重启后恢复
+type jobRecord struct {
+	Job
+	Token    string                 `json:"token"`
+	Vars     map[string]interface{} `json:"vars"`
+	IdemKey  string                 `json:"idempotency_key,omitempty"`
+	IdemHash string                 `json:"idempotency_hash,omitempty"`
+}
+
+// ErrIdempotencyMismatch 重用的 Idempotency-Key 对应的请求内容不同
+var ErrIdempotencyMismatch = errors.New("Idempotency-Key 已用于内容不同的请求")
+
+// JobStore 任务存储，终态任务保留 config.JobRetention 后自动清理
+type JobStore struct {
+	dir      string // 任务日志目录，为空时不落盘
+	mu       sync.RWMutex
+	jobs     map[string]*Job          // job_id -> Job
+	byPrompt map[string]string        // prompt_id -> job_id
+	byIdem   map[string]string        // token + Idempotency-Key -> job_id
+	done     map[string]chan struct{} // job_id -> 任务结束信号
+}
+
+func NewJobStore(dir string) *JobStore {
+	store := &JobStore{
+		dir:      dir,
+		jobs:     make(map[string]*Job),
+		byPrompt: make(map[string]string),
+		byIdem:   make(map[string]string),
+		done:     make(map[string]chan struct{}),
+	}
+	store.load()
+	go store.cleanupLoop()
+	return store
+}
+
+// load 从任务日志目录恢复任务
+func (s *JobStore) load() {
+	if s.dir == "" {
+		return
+	}
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		LogAPIRuntime(ColorRed+"[JobStore] 创建任务日志目录失败: %s", err)
+		return
+	}
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		LogAPIRuntime(ColorRed+"[JobStore] 读取任务日志目录失败: %s", err)
+		return
+	}
+
+	expire := time.Now().Add(-config.JobRetention * time.Second)
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			LogAPIRuntime(ColorRed+"[JobStore] 读取任务日志失败: %s, %s", file.Name(), err)
+			continue
+		}
+		var record jobRecord
+		if err := json.Unmarshal(data, &record); err != nil || record.ID == "" {
+			LogAPIRuntime(ColorRed+"[JobStore] 解析任务日志失败: %s, %v", file.Name(), err)
+			continue
+		}
+
+		job := record.Job
+		if job.State.IsFinished() && job.UpdatedAt.Before(expire) {
+			// 超过保留期的终态任务不再恢复，顺带删除日志
+			s.removeJournal(job.ID)
+			continue
+		}
+		job.Token = record.Token
+		job.Vars = record.Vars
+		job.IdemKey = record.IdemKey
+		job.IdemHash = record.IdemHash
+		s.jobs[job.ID] = &job
+		if job.PromptID != "" {
+			s.byPrompt[job.PromptID] = job.ID
+		}
+		if job.IdemKey != "" {
+			s.byIdem[idemIndex(job.Token, job.IdemKey)] = job.ID
+		}
+		done := make(chan struct{})
+		if job.State.IsFinished() {
+			close(done)
+		}
+		s.done[job.ID] = done
+	}
+	LogAPIRuntime("[JobStore] 从任务日志恢复 %d 个任务", len(s.jobs))
+}
+
+// persist 覆盖写入任务日志（先写临时文件再重命名，避免写一半时崩溃）
+func (s *JobStore) persist(job *Job) {
+	if s.dir == "" {
+		return
+	}
+	data, err := json.Marshal(jobRecord{Job: *job, Token: job.Token, Vars: job.Vars, IdemKey: job.IdemKey, IdemHash: job.IdemHash})
+	if err != nil {
+		LogAPIRuntime(ColorRed+"[JobStore] 序列化任务失败: %s", err)
+		return
+	}
+	path := filepath.Join(s.dir, job.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		LogAPIRuntime(ColorRed+"[JobStore] 写入任务日志失败: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		LogAPIRuntime(ColorRed+"[JobStore] 写入任务日志失败: %s", err)
+	}
+}
+
+// Unfinished 返回所有未结束的任务（用于重启后对账）
+func (s *JobStore) Unfinished() []Job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := []Job{}
+	for _, job := range s.jobs {
+		if !job.State.IsFinished() {
+			list = append(list, *job)
+		}
+	}
+	return list
+}
+
+// Create 登记一个新任务
+// 携带 Idempotency-Key 且同一 token 下已存在对应任务时，返回原任务且 created 为 false；
+// 请求内容（API、变量、文件、回调地址、优先级）与原任务不同时返回 ErrIdempotencyMismatch；
+// 原任务提交失败（未拿到 prompt_id）时视为可重试，重新登记；vars 为写入任务日志的变量
+func (s *JobStore) Create(req GenerateRequest, apiName string, vars map[string]interface{}) (job Job, created bool, err error) {
+	hash := ""
+	if req.IdempotencyKey != "" {
+		hash = requestHash(req, apiName)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.IdempotencyKey != "" {
+		if id, ok := s.byIdem[idemIndex(req.Token, req.IdempotencyKey)]; ok {
+			if existing, ok := s.jobs[id]; ok && !(existing.State == JobFailed && existing.PromptID == "") {
+				// 旧版本的任务日志没有摘要，不做校验
+				if existing.IdemHash != "" && existing.IdemHash != hash {
+					return Job{}, false, fmt.Errorf("%w: %s", ErrIdempotencyMismatch, req.IdempotencyKey)
+				}
+				return *existing, false, nil
+			}
+		}
+	}
+
+	now := time.Now()
+	newJob := &Job{
+		ID:        strings.ReplaceAll(uuid.NewString(), "-", ""),
+		Token:     req.Token,
+		APIName:   apiName,
+		Vars:      vars,
+		Callback:  req.CallbackURL,
+		IdemKey:   req.IdempotencyKey,
+		IdemHash:  hash,
+		State:     JobPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.jobs[newJob.ID] = newJob
+	s.done[newJob.ID] = make(chan struct{})
+	if newJob.IdemKey != "" {
+		s.byIdem[idemIndex(newJob.Token, newJob.IdemKey)] = newJob.ID
+	}
+	s.persist(newJob)
+	return *newJob, true, nil
+}
+
+// idemIndex Idempotency-Key 索引，不同 token 之间互不影响
+func idemIndex(token, key string) string {
+	return token + "\x00" + key
+}
+
+// requestHash 请求内容摘要，上传的文件按内容摘要计入（JSON 序列化 map 时按 key 排序，结果稳定）
+func requestHash(req GenerateRequest, apiName string) string {
+	vars := req.Vars
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	files := make(map[string]string, len(req.Files))
+	for name, file := range req.Files {
+		sum := sha256.Sum256(file.Data)
+		files[name] = hex.EncodeToString(sum[:])
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"api":          apiName,
+		"vars":         vars,
+		"files":        files,
+		"callback_url": req.CallbackURL,
+		"priority":     req.Priority,
+	})
+	if err != nil {
+		// 变量来自 JSON 请求体，不会序列化失败；兜底按原始格式计算
+		data = []byte(fmt.Sprintf("%s|%v|%v|%s|%d", apiName, vars, files, req.CallbackURL, req.Priority))
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get 根据 job_id 获取任务快照
+func (s *JobStore) Get(id string) (Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// GetByPrompt 根据 prompt_id 获取任务快照
+func (s *JobStore) GetByPrompt(promptID string) (Job, bool) {
+	s.mu.RLock()
+	id, ok := s.byPrompt[promptID]
+	s.mu.RUnlock()
+	if !ok {
+		return Job{}, false
+	}
+	return s.Get(id)
+}
+
+// SetSubmitted 记录任务提交到的节点、prompt_id 以及已尝试过的节点，故障转移重新提交后状态回到 queued
+func (s *JobStore) SetSubmitted(id, node, promptID string, tried []string) {
+	s.update(id, func(job *Job) {
+		if job.PromptID != "" {
+			delete(s.byPrompt, job.PromptID)
+		}
+		job.Node = node
+		job.PromptID = promptID
+		job.Tried = tried
+		job.State = JobQueued
+		s.byPrompt[promptID] = id
+	})
+}
+
+// SetState 更新任务状态（终态请使用 Succeed / Fail）
+func (s *JobStore) SetState(id string, state JobState) {
+	s.update(id, func(job *Job) {
+		job.State = state
+	})
+}
+
+// Succeed 任务成功
+func (s *JobStore) Succeed(id string, outputs []model.NodeOutput) {
+	s.finish(id, func(job *Job) {
+		job.State = JobSucceeded
+		job.Outputs = outputs
+		job.URLs = model.FlattenURLs(outputs)
+	})
+}
+
+// Fail 任务失败
+func (s *JobStore) Fail(id string, err error) {
+	s.finish(id, func(job *Job) {
+		job.State = JobFailed
+		job.Error = err.Error()
+		var execErr *ExecutionError
+		if errors.As(err, &execErr) {
+			job.ErrorInfo = execErr
+		}
+		var overload *OverloadError
+		if errors.As(err, &overload) {
+			job.RetryAfter = int(math.Ceil(overload.RetryAfter.Seconds()))
+		}
+	})
+}
+
+// Cancel 任务被取消
+func (s *JobStore) Cancel(id string) {
+	s.finish(id, func(job *Job) {
+		job.State = JobCancelled
+		job.Error = ErrTaskCancelled.Error()
+	})
+}
+
+// Done 返回任务结束信号
+func (s *JobStore) Done(id string) <-chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.done[id]
+}
+
+// update 在锁内修改任务，终态任务不再修改
+func (s *JobStore) update(id string, fn func(job *Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok || job.State.IsFinished() {
+		return
+	}
+	fn(job)
+	job.UpdatedAt = time.Now()
+	s.persist(job)
+}
+
+// finish 修改任务为终态，并通知等待者
+func (s *JobStore) finish(id string, fn func(job *Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok || job.State.IsFinished() {
+		return
+	}
+	fn(job)
+	job.UpdatedAt = time.Now()
+	s.persist(job)
+	close(s.done[id])
+}
+
+// cleanupLoop 定期清理过期的终态任务
+func (s *JobStore) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.cleanup()
+	}
+}
+
+// cleanup 清理超过保留期的终态任务，同时删除任务日志
+func (s *JobStore) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expire := time.Now().Add(-config.JobRetention * time.Second)
+	for id, job := range s.jobs {
+		if job.State.IsFinished() && job.UpdatedAt.Before(expire) {
+			delete(s.jobs, id)
+			delete(s.done, id)
+			delete(s.byPrompt, job.PromptID)
+			if job.IdemKey != "" && s.byIdem[idemIndex(job.Token, job.IdemKey)] == id {
+				delete(s.byIdem, idemIndex(job.Token, job.IdemKey))
+			}
+			s.removeJournal(id)
+		}
+	}
+}
+
+// removeJournal 删除任务日志
+func (s *JobStore) removeJournal(id string) {
+	if s.dir == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(s.dir, id+".json")); err != nil && !os.IsNotExist(err) {
+		LogAPIRuntime(ColorRed+"[JobStore] 删除任务日志失败: %s", err)
+	}
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestJobStoreIdempotency(t *testing.T) {
+	base := func() GenerateRequest {
+		return GenerateRequest{
+			Token:          "token-a",
+			Vars:           map[string]interface{}{"prompt": "a cat", "seed": float64(1)},
+			CallbackURL:    "https://example.com/callback",
+			Priority:       1,
+			Files:          map[string]InputFile{"image": {Filename: "a.png", Data: []byte("image-a")}},
+			IdempotencyKey: "key-1",
+		}
+	}
+	tests := []struct {
+		name     string
+		apiName  string
+		modify   func(req *GenerateRequest)
+		failed   bool // 原任务提交失败，未拿到 prompt_id
+		created  bool
+		mismatch bool
+	}{
+		{name: "same request", apiName: "api", modify: func(req *GenerateRequest) {}},
+		{name: "vars key order irrelevant", apiName: "api", modify: func(req *GenerateRequest) {
+			req.Vars = map[string]interface{}{"seed": float64(1), "prompt": "a cat"}
+		}},
+		{name: "different vars", apiName: "api", modify: func(req *GenerateRequest) { req.Vars["prompt"] = "a dog" }, mismatch: true},
+		{name: "different api", apiName: "other", modify: func(req *GenerateRequest) {}, mismatch: true},
+		{name: "different file content", apiName: "api", modify: func(req *GenerateRequest) {
+			req.Files = map[string]InputFile{"image": {Filename: "a.png", Data: []byte("image-b")}}
+		}, mismatch: true},
+		{name: "file name irrelevant", apiName: "api", modify: func(req *GenerateRequest) {
+			req.Files = map[string]InputFile{"image": {Filename: "b.png", Data: []byte("image-a")}}
+		}},
+		{name: "different callback", apiName: "api", modify: func(req *GenerateRequest) { req.CallbackURL = "https://example.com/other" }, mismatch: true},
+		{name: "different priority", apiName: "api", modify: func(req *GenerateRequest) { req.Priority = 2 }, mismatch: true},
+		{name: "different token", apiName: "api", modify: func(req *GenerateRequest) {
+			req.Token = "token-b"
+			req.Vars["prompt"] = "a dog"
+		}, created: true},
+		{name: "different key", apiName: "api", modify: func(req *GenerateRequest) {
+			req.IdempotencyKey = "key-2"
+			req.Vars["prompt"] = "a dog"
+		}, created: true},
+		{name: "without key", apiName: "api", modify: func(req *GenerateRequest) { req.IdempotencyKey = "" }, created: true},
+		{name: "original failed before submit", apiName: "api", modify: func(req *GenerateRequest) { req.Vars["prompt"] = "a dog" }, failed: true, created: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewJobStore("")
+			req := base()
+			original, created, err := store.Create(req, "api", req.Vars)
+			if err != nil || !created {
+				t.Fatalf("first Create() = %v, %v", created, err)
+			}
+			if tt.failed {
+				store.Fail(original.ID, errors.New("submit failed"))
+			}
+
+			retry := base()
+			tt.modify(&retry)
+			job, created, err := store.Create(retry, tt.apiName, retry.Vars)
+			if tt.mismatch {
+				if !errors.Is(err, ErrIdempotencyMismatch) {
+					t.Fatalf("Create() error = %v, want ErrIdempotencyMismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			if created != tt.created {
+				t.Fatalf("Create() created = %v, want %v", created, tt.created)
+			}
+			if !created && job.ID != original.ID {
+				t.Fatalf("Create() job = %s, want original %s", job.ID, original.ID)
+			}
+			if created && job.ID == original.ID {
+				t.Fatalf("Create() reused job %s", job.ID)
+			}
+		})
+	}
+}
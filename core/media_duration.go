@@ -0,0 +1,336 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+/*
+
+音视频时长解析
+
+网关不依赖 ffprobe，只解析常见容器的文件头获取时长，用于 audio / video 变量的时长限制：
+- WAV / AVI（RIFF）
+- FLAC（STREAMINFO）
+- MP3（Xing / Info 帧数，没有时按首帧码率估算）
+- OGG（最后一页的 granule position，Vorbis / Opus）
+- MP4 / MOV / M4A（moov.mvhd）
+- WebM / MKV（Segment.Info.Duration）
+
+无法识别的格式返回 false，不做时长限制（大小限制照常生效）
+*/
+
+// mediaDuration 解析音视频时长
+func mediaDuration(data []byte) (time.Duration, bool) {
+	switch {
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		return wavDuration(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "AVI ":
+		return aviDuration(data)
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return flacDuration(data)
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return oggDuration(data)
+	case len(data) >= 8 && string(data[4:8]) == "ftyp":
+		return mp4Duration(data)
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return matroskaDuration(data)
+	}
+	return mp3Duration(data)
+}
+
+// seconds 辅助函数：秒数转换为 time.Duration
+func seconds(s float64) (time.Duration, bool) {
+	if s <= 0 || math.IsNaN(s) || math.IsInf(s, 0) {
+		return 0, false
+	}
+	return time.Duration(s * float64(time.Second)), true
+}
+
+// wavDuration data 块大小 / fmt 块中的 byte rate
+func wavDuration(data []byte) (time.Duration, bool) {
+	var byteRate uint32
+	for offset := 12; offset+8 <= len(data); {
+		id := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		body := offset + 8
+		switch id {
+		case "fmt ":
+			if body+12 > len(data) {
+				return 0, false
+			}
+			byteRate = binary.LittleEndian.Uint32(data[body+8:])
+		case "data":
+			if byteRate == 0 {
+				return 0, false
+			}
+			return seconds(float64(size) / float64(byteRate))
+		}
+		offset = body + size + size%2
+	}
+	return 0, false
+}
+
+// aviDuration avih 中的 dwMicroSecPerFrame * dwTotalFrames
+func aviDuration(data []byte) (time.Duration, bool) {
+	i := bytes.Index(data, []byte("avih"))
+	if i < 0 || i+8+20 > len(data) {
+		return 0, false
+	}
+	body := data[i+8:]
+	microSecPerFrame := binary.LittleEndian.Uint32(body[0:])
+	totalFrames := binary.LittleEndian.Uint32(body[16:])
+	return seconds(float64(microSecPerFrame) * float64(totalFrames) / 1e6)
+}
+
+// flacDuration STREAMINFO 中的总采样数 / 采样率
+func flacDuration(data []byte) (time.Duration, bool) {
+	// "fLaC" + 4 字节块头 + STREAMINFO（34 字节），采样率 20 位、声道 3 位、位深 5 位、总采样数 36 位
+	if len(data) < 8+18 {
+		return 0, false
+	}
+	info := data[8:]
+	sampleRate := uint32(info[10])<<12 | uint32(info[11])<<4 | uint32(info[12])>>4
+	totalSamples := uint64(info[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(info[14:]))
+	if sampleRate == 0 {
+		return 0, false
+	}
+	return seconds(float64(totalSamples) / float64(sampleRate))
+}
+
+// oggDuration 最后一页的 granule position / 采样率（Opus 固定 48000）
+func oggDuration(data []byte) (time.Duration, bool) {
+	// 第一页的第一个包为编码头
+	if len(data) < 27 {
+		return 0, false
+	}
+	segments := int(data[26])
+	packet := data[min(27+segments, len(data)):]
+	var sampleRate uint32
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+		sampleRate = binary.LittleEndian.Uint32(packet[12:])
+	case bytes.HasPrefix(packet, []byte("OpusHead")):
+		sampleRate = 48000
+	default:
+		return 0, false
+	}
+
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if last < 0 || last+14 > len(data) || sampleRate == 0 {
+		return 0, false
+	}
+	granule := int64(binary.LittleEndian.Uint64(data[last+6:]))
+	return seconds(float64(granule) / float64(sampleRate))
+}
+
+// mp4Duration moov.mvhd 中的 duration / timescale
+func mp4Duration(data []byte) (time.Duration, bool) {
+	moov, ok := findBox(data, "moov")
+	if !ok {
+		return 0, false
+	}
+	mvhd, ok := findBox(moov, "mvhd")
+	if !ok || len(mvhd) < 4 {
+		return 0, false
+	}
+	var timescale uint32
+	var duration uint64
+	if mvhd[0] == 1 {
+		// version 1: 8 字节 creation / modification time 与 duration
+		if len(mvhd) < 32 {
+			return 0, false
+		}
+		timescale = binary.BigEndian.Uint32(mvhd[20:])
+		duration = binary.BigEndian.Uint64(mvhd[24:])
+	} else {
+		if len(mvhd) < 20 {
+			return 0, false
+		}
+		timescale = binary.BigEndian.Uint32(mvhd[12:])
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	}
+	if timescale == 0 {
+		return 0, false
+	}
+	return seconds(float64(duration) / float64(timescale))
+}
+
+// findBox 在同一层级中查找 MP4 box，返回 box 内容
+func findBox(data []byte, name string) ([]byte, bool) {
+	for offset := 0; offset+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[offset:]))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data) - offset)
+		case 1:
+			if offset+16 > len(data) {
+				return nil, false
+			}
+			size = binary.BigEndian.Uint64(data[offset+8:])
+			header = 16
+		}
+		// 先与剩余长度比较再相加，超大的 largesize 不会回绕；size >= header 保证 offset 严格递增
+		if size < header || size > uint64(len(data)-offset) {
+			return nil, false
+		}
+		if string(data[offset+4:offset+8]) == name {
+			return data[offset+int(header) : offset+int(size)], true
+		}
+		offset += int(size)
+	}
+	return nil, false
+}
+
+// Matroska / WebM 元素 ID
+const (
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+)
+
+// matroskaDuration Segment.Info 中的 Duration * TimecodeScale（纳秒）
+func matroskaDuration(data []byte) (time.Duration, bool) {
+	segment, ok := findEBML(data, ebmlSegment)
+	if !ok {
+		return 0, false
+	}
+	info, ok := findEBML(segment, ebmlInfo)
+	if !ok {
+		return 0, false
+	}
+	scale := uint64(1000000)
+	if value, ok := findEBML(info, ebmlTimecodeScale); ok && len(value) > 0 && len(value) <= 8 {
+		scale = 0
+		for _, b := range value {
+			scale = scale<<8 | uint64(b)
+		}
+	}
+	value, ok := findEBML(info, ebmlDuration)
+	if !ok {
+		return 0, false
+	}
+	var ticks float64
+	switch len(value) {
+	case 4:
+		ticks = float64(math.Float32frombits(binary.BigEndian.Uint32(value)))
+	case 8:
+		ticks = math.Float64frombits(binary.BigEndian.Uint64(value))
+	default:
+		return 0, false
+	}
+	return seconds(ticks * float64(scale) / 1e9)
+}
+
+// findEBML 在同一层级中查找 EBML 元素，返回元素内容；未知长度的元素内容截止到数据末尾
+func findEBML(data []byte, id uint32) ([]byte, bool) {
+	for offset := 0; offset < len(data); {
+		elementID, n := readVint(data[offset:], true)
+		if n == 0 {
+			return nil, false
+		}
+		offset += n
+		size, m := readVint(data[offset:], false)
+		if m == 0 {
+			return nil, false
+		}
+		offset += m
+		end := len(data)
+		if size != 1<<(7*m)-1 && uint64(offset)+size <= uint64(len(data)) {
+			end = offset + int(size)
+		}
+		if uint32(elementID) == id {
+			return data[offset:end], true
+		}
+		offset = end
+	}
+	return nil, false
+}
+
+// readVint 读取 EBML 变长整数，keepMarker 为 true 时保留长度标记位（元素 ID），返回值与占用字节数
+func readVint(data []byte, keepMarker bool) (uint64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || length > len(data) {
+		return 0, 0
+	}
+	value := uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+// MP3（MPEG Layer III）码率（kbps）与采样率表
+var (
+	mp3BitratesV1 = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mp3BitratesV2 = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+	mp3Rates      = [3]int{44100, 48000, 32000}
+)
+
+// mp3Duration 有 Xing / Info 头时按帧数计算，否则按首帧码率估算（CBR）
+func mp3Duration(data []byte) (time.Duration, bool) {
+	offset := 0
+	if bytes.HasPrefix(data, []byte("ID3")) && len(data) >= 10 {
+		// ID3v2 标签长度为 syncsafe 整数
+		size := int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9])
+		offset = 10 + size
+	}
+	if offset+4 > len(data) || data[offset] != 0xFF || data[offset+1]&0xE0 != 0xE0 {
+		return 0, false
+	}
+	header := data[offset : offset+4]
+	version := (header[1] >> 3) & 0x03 // 3: MPEG1, 2: MPEG2, 0: MPEG2.5
+	layer := (header[1] >> 1) & 0x03   // 1: Layer III
+	bitrateIndex := header[2] >> 4
+	rateIndex := (header[2] >> 2) & 0x03
+	mono := header[3]>>6 == 3
+	if layer != 1 || version == 1 || rateIndex == 3 {
+		return 0, false
+	}
+
+	sampleRate := mp3Rates[rateIndex]
+	bitrate := mp3BitratesV1[bitrateIndex]
+	samplesPerFrame := 1152
+	sideInfo := 32
+	if mono {
+		sideInfo = 17
+	}
+	if version != 3 {
+		bitrate = mp3BitratesV2[bitrateIndex]
+		samplesPerFrame = 576
+		sideInfo = 17
+		if mono {
+			sideInfo = 9
+		}
+		sampleRate /= 2
+		if version == 0 {
+			sampleRate /= 2
+		}
+	}
+
+	xing := offset + 4 + sideInfo
+	if xing+12 <= len(data) {
+		tag := string(data[xing : xing+4])
+		if (tag == "Xing" || tag == "Info") && binary.BigEndian.Uint32(data[xing+4:])&0x01 != 0 {
+			frames := binary.BigEndian.Uint32(data[xing+8:])
+			return seconds(float64(frames) * float64(samplesPerFrame) / float64(sampleRate))
+		}
+	}
+	if bitrate == 0 {
+		return 0, false
+	}
+	return seconds(float64(len(data)-offset) * 8 / float64(bitrate*1000))
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// mp4Box 构造 MP4 box
+func mp4Box(name string, body []byte) []byte {
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	box = append(box, name...)
+	return append(box, body...)
+}
+
+// mvhdBody version 0 的 mvhd：timescale 与 duration
+func mvhdBody(timescale, duration uint32) []byte {
+	body := make([]byte, 20)
+	binary.BigEndian.PutUint32(body[12:], timescale)
+	binary.BigEndian.PutUint32(body[16:], duration)
+	return body
+}
+
+func testWAV(byteRate uint32, dataSize uint32) []byte {
+	fmtBody := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtBody[0:], 1)
+	binary.LittleEndian.PutUint32(fmtBody[8:], byteRate)
+	buf := []byte("RIFF\x00\x00\x00\x00WAVE")
+	buf = append(buf, "fmt "...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(fmtBody)))
+	buf = append(buf, fmtBody...)
+	buf = append(buf, "data"...)
+	return binary.LittleEndian.AppendUint32(buf, dataSize)
+}
+
+func testFLAC(sampleRate uint32, totalSamples uint64) []byte {
+	info := make([]byte, 34)
+	info[10] = byte(sampleRate >> 12)
+	info[11] = byte(sampleRate >> 4)
+	info[12] = byte(sampleRate<<4) | 0x02 // 声道、位深不影响时长
+	info[13] = byte(totalSamples>>32) & 0x0F
+	binary.BigEndian.PutUint32(info[14:], uint32(totalSamples))
+	return append([]byte("fLaC\x00\x00\x00\x22"), info...)
+}
+
+func testOgg(granule uint64) []byte {
+	page := func(packet []byte, granule uint64) []byte {
+		header := make([]byte, 27)
+		copy(header, "OggS")
+		binary.LittleEndian.PutUint64(header[6:], granule)
+		header[26] = 1
+		header = append(header, byte(len(packet)))
+		return append(header, packet...)
+	}
+	opus := append([]byte("OpusHead"), make([]byte, 11)...)
+	return append(page(opus, 0), page([]byte{0}, granule)...)
+}
+
+func testMatroska(durationMS float64) []byte {
+	duration := binary.BigEndian.AppendUint64(nil, math.Float64bits(durationMS))
+	info := append([]byte{0x44, 0x89, 0x88}, duration...)
+	segment := append([]byte{0x15, 0x49, 0xA9, 0x66, 0x80 | byte(len(info))}, info...)
+	buf := []byte{0x1A, 0x45, 0xDF, 0xA3, 0x80}
+	return append(append(buf, 0x18, 0x53, 0x80, 0x67, 0x80|byte(len(segment))), segment...)
+}
+
+func TestMediaDuration(t *testing.T) {
+	ftyp := mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isommp41"))
+	// largesize 接近 2^64 的 box，相加会回绕
+	oversized := append([]byte{0, 0, 0, 1}, "free"...)
+	oversized = binary.BigEndian.AppendUint64(oversized, math.MaxUint64-7)
+
+	tests := []struct {
+		name string
+		data []byte
+		want time.Duration
+		ok   bool
+	}{
+		{"wav", testWAV(176400, 176400*3), 3 * time.Second, true},
+		{"wav without fmt", testWAV(0, 100), 0, false},
+		{"flac", testFLAC(44100, 44100*5), 5 * time.Second, true},
+		{"flac truncated", []byte("fLaC\x00\x00"), 0, false},
+		{"ogg opus", testOgg(48000 * 2), 2 * time.Second, true},
+		{"mp4", append(ftyp, mp4Box("moov", mp4Box("mvhd", mvhdBody(1000, 7500)))...), 7500 * time.Millisecond, true},
+		{"mp4 without moov", ftyp, 0, false},
+		{"mp4 truncated box", append(ftyp, 0, 0, 0x10, 0, 'm', 'o', 'o', 'v'), 0, false},
+		{"mp4 oversized largesize", append(ftyp, oversized...), 0, false},
+		{"mp4 largesize loops back", append(mp4Box("ftyp", nil), oversized...), 0, false},
+		{"mp4 zero size timescale", append(ftyp, mp4Box("moov", mp4Box("mvhd", mvhdBody(0, 10)))...), 0, false},
+		{"matroska", testMatroska(4000), 4 * time.Second, true},
+		{"mp3 cbr", append([]byte{0xFF, 0xFB, 0x90, 0x00}, make([]byte, 16000-4)...), time.Second, true},
+		{"unknown", []byte("not a media file"), 0, false},
+		{"empty", nil, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type result struct {
+				duration time.Duration
+				ok       bool
+			}
+			done := make(chan result, 1)
+			go func() {
+				duration, ok := mediaDuration(tt.data)
+				done <- result{duration, ok}
+			}()
+			select {
+			case got := <-done:
+				if got.ok != tt.ok || (tt.ok && (got.duration-tt.want).Abs() > time.Millisecond) {
+					t.Fatalf("mediaDuration() = %v, %v; want %v, %v", got.duration, got.ok, tt.want, tt.ok)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("mediaDuration did not return")
+			}
+		})
+	}
+}
+
+func TestFindBoxMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"size smaller than header", []byte{0, 0, 0, 4, 'f', 'r', 'e', 'e'}},
+		{"size beyond data", []byte{0, 0, 0, 0x20, 'f', 'r', 'e', 'e', 1, 2}},
+		{"largesize truncated", []byte{0, 0, 0, 1, 'f', 'r', 'e', 'e', 0, 0}},
+		{"largesize wraps", binary.BigEndian.AppendUint64([]byte{0, 0, 0, 1, 'f', 'r', 'e', 'e'}, math.MaxUint64-7)},
+		{"largesize loops back", binary.BigEndian.AppendUint64([]byte{0, 0, 0, 8, 'f', 't', 'y', 'p', 0, 0, 0, 1, 'f', 'r', 'e', 'e'}, math.MaxUint64-7)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append(bytes.Clone(tt.data), make([]byte, 8)...)
+			done := make(chan bool, 1)
+			go func() {
+				_, ok := findBox(data, "moov")
+				done <- ok
+			}()
+			select {
+			case ok := <-done:
+				if ok {
+					t.Fatal("findBox() found a box in malformed data")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("findBox did not return")
+			}
+		})
+	}
+}
@@ -12,7 +12,12 @@ import (
 
 // 定义接口
 type TaskNotifier interface {
-	NotifyTaskDone(promptID string, addresses []model.Address)
+	NotifyTaskStart(promptID string)
+	NotifyProgress(event ProgressEvent)
+	NotifyNodeOutput(promptID string, nodeID string, addresses []model.Address)
+	NotifyTaskDone(promptID string)
+	NotifyTaskFailed(promptID string, err *ExecutionError)
+	NotifyConnectionLost(host string)
 }
 
 // MessageWorker 简化的消息工作者，面向特定 host 建立 WebSocket 连接并消费消息
@@ -139,6 +144,16 @@ func (w *MessageWorker) handleMessage(msg ComfyUIMessage) {
 		if err := json.Unmarshal(msg.Data, &data); err == nil {
 			w.handleExecutionSuccess(data)
 		}
+	case "execution_error":
+		var data ExecutionErrorData
+		if err := json.Unmarshal(msg.Data, &data); err == nil {
+			w.handleExecutionError(data)
+		}
+	case "execution_interrupted":
+		var data ExecutionInterruptedData
+		if err := json.Unmarshal(msg.Data, &data); err == nil {
+			w.handleExecutionInterrupted(data)
+		}
 	case "status":
 		var data StatusData
 		if err := json.Unmarshal(msg.Data, &data); err == nil {
@@ -216,6 +231,27 @@ type ExecutionData struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
+// 执行出错
+type ExecutionErrorData struct {
+	PromptID         string   `json:"prompt_id"`
+	NodeID           string   `json:"node_id"`
+	NodeType         string   `json:"node_type"`
+	Executed         []string `json:"executed"`
+	ExceptionMessage string   `json:"exception_message"`
+	ExceptionType    string   `json:"exception_type"`
+	Traceback        []string `json:"traceback"`
+	Timestamp        int64    `json:"timestamp"`
+}
+
+// 执行被中断
+type ExecutionInterruptedData struct {
+	PromptID  string   `json:"prompt_id"`
+	NodeID    string   `json:"node_id"`
+	NodeType  string   `json:"node_type"`
+	Executed  []string `json:"executed"`
+	Timestamp int64    `json:"timestamp"`
+}
+
 // 状态消息
 type StatusData struct {
 	SID    string `json:"sid"`
@@ -300,22 +336,86 @@ type ImpactNodeFeedbackData struct {
 
 func (w *MessageWorker) handleProgress(data ProgressData) {
 	LogMessageWorker("[Progress] prompt_id: %s node: %s %d/%d", data.PromptID, data.Node, data.Value, data.Max)
+	w.notifyProgress(ProgressEvent{
+		Type:     EventProgress,
+		PromptID: data.PromptID,
+		Node:     data.Node,
+		Value:    data.Value,
+		Max:      data.Max,
+	})
 }
 
 func (w *MessageWorker) handleExecuting(data ExecutingData) {
 	LogMessageWorker("[Executing] prompt_id: %s node: %s display_node: %s", data.PromptID, data.Node, data.DisplayNode)
+	w.notifyProgress(ProgressEvent{
+		Type:     EventExecuting,
+		PromptID: data.PromptID,
+		Node:     data.Node,
+	})
+	// node 为 null 表示整个 prompt 执行完毕（兼容没有 execution_success 的旧版本 ComfyUI）
+	if data.Node == "" && data.PromptID != "" && w.notifier != nil {
+		w.notifier.NotifyTaskDone(data.PromptID)
+	}
 }
 
 func (w *MessageWorker) handleExecutionCached(data ExecutionCachedData) {
 	LogMessageWorker("[ExecutionCached] prompt_id: %s nodes: %v timestamp: %d", data.PromptID, data.Nodes, data.Timestamp)
+	w.notifyProgress(ProgressEvent{
+		Type:     EventExecutionCached,
+		PromptID: data.PromptID,
+		Nodes:    data.Nodes,
+	})
+}
+
+// notifyProgress 将进度事件转交给上层
+func (w *MessageWorker) notifyProgress(event ProgressEvent) {
+	if w.notifier != nil && event.PromptID != "" {
+		w.notifier.NotifyProgress(event)
+	}
 }
 
 func (w *MessageWorker) handleExecutionStart(data ExecutionData) {
 	LogMessageWorker("[ExecutionStart] prompt_id: %s timestamp: %d", data.PromptID, data.Timestamp)
+	if w.notifier != nil {
+		w.notifier.NotifyTaskStart(data.PromptID)
+	}
 }
 
 func (w *MessageWorker) handleExecutionSuccess(data ExecutionData) {
 	LogMessageWorker("[ExecutionSuccess] prompt_id: %s timestamp: %d", data.PromptID, data.Timestamp)
+	// ✅ 所有输出节点执行完毕，通知上层任务完成
+	if w.notifier != nil {
+		LogMessageWorker("⚡️ 通知上层事务任务完成")
+		w.notifier.NotifyTaskDone(data.PromptID)
+	}
+}
+
+func (w *MessageWorker) handleExecutionError(data ExecutionErrorData) {
+	LogMessageWorker(ColorRed+"[ExecutionError] prompt_id: %s node: %s(%s) %s: %s",
+		data.PromptID, data.NodeID, data.NodeType, data.ExceptionType, data.ExceptionMessage)
+	if w.notifier != nil {
+		w.notifier.NotifyTaskFailed(data.PromptID, &ExecutionError{
+			PromptID:         data.PromptID,
+			NodeID:           data.NodeID,
+			NodeType:         data.NodeType,
+			ExceptionType:    data.ExceptionType,
+			ExceptionMessage: data.ExceptionMessage,
+			Traceback:        data.Traceback,
+		})
+	}
+}
+
+func (w *MessageWorker) handleExecutionInterrupted(data ExecutionInterruptedData) {
+	LogMessageWorker(ColorYellow+"[ExecutionInterrupted] prompt_id: %s node: %s(%s)", data.PromptID, data.NodeID, data.NodeType)
+	if w.notifier != nil {
+		w.notifier.NotifyTaskFailed(data.PromptID, &ExecutionError{
+			PromptID:         data.PromptID,
+			NodeID:           data.NodeID,
+			NodeType:         data.NodeType,
+			ExceptionMessage: "execution interrupted",
+			Interrupted:      true,
+		})
+	}
 }
 
 func (w *MessageWorker) handleStatus(data StatusData) {
@@ -334,6 +434,10 @@ func (w *MessageWorker) handleWSConnected() {
 
 func (w *MessageWorker) handleWSReconnect() {
 	LogMessageWorker("[WSReconnect] 尝试重连")
+	// 连接中断期间的事件会丢失，通知对账该节点上的任务
+	if w.notifier != nil {
+		w.notifier.NotifyConnectionLost(w.host)
+	}
 }
 
 func (w *MessageWorker) handleWSExit() {
@@ -345,6 +449,11 @@ func (w *MessageWorker) handleError(data SystemData) {
 }
 
 func (w *MessageWorker) handleMonitor(data MonitorData) {
+	// 转发给注册表用于资源感知调度
+	if receiver, ok := w.notifier.(TelemetryReceiver); ok {
+		receiver.NotifyMonitor(w.host, data)
+	}
+
 	// 打印监控日志
 	if len(data.GPUs) > 0 {
 		LogMessageWorker("[Monitor] 服务器: %s, CPU: %.1f%%, 内存: %.1f%% (%d/%d MB), GPU: %d°C, VRAM: %.1f%% (%d/%d MB)",
@@ -405,55 +514,58 @@ func (w *MessageWorker) handleExecuted(data ExecutedData) {
 	// 任意长度数组
 	addresses := make([]model.Address, 0)
 	// 1️⃣ 获取图像结果
-	if len(data.Output.Images) > 0 {
-		//addresses := make([]model.Address, 0, len(data.Output.Images))
-		for _, img := range data.Output.Images {
-			addresses = append(addresses, model.Address{
-				Subfolder: img.Subfolder,
-				Filename:  img.Filename,
-			})
-		}
-
+	for _, img := range data.Output.Images {
+		addresses = append(addresses, model.Address{
+			Subfolder: img.Subfolder,
+			Filename:  img.Filename,
+			Type:      img.Type,
+		})
 	}
 
 	// 2️⃣ 获取音频结果
-	if len(data.Output.Audio) > 0 {
-		//addresses := make([]model.Address, 0, len(data.Output.Audio))
-		for _, audio := range data.Output.Audio {
-			addresses = append(addresses, model.Address{
-				Subfolder: audio.Subfolder,
-				Filename:  audio.Filename,
-			})
-		}
+	for _, audio := range data.Output.Audio {
+		addresses = append(addresses, model.Address{
+			Subfolder: audio.Subfolder,
+			Filename:  audio.Filename,
+			Type:      audio.Type,
+		})
 	}
 
 	// 3️⃣ 获取视频结果
-	if len(data.Output.Videos) > 0 {
-		//addresses := make([]model.Address, 0, len(data.Output.Videos))
-		for _, video := range data.Output.Videos {
-			addresses = append(addresses, model.Address{
-				Subfolder: video.Subfolder,
-				Filename:  video.Filename,
-			})
-		}
+	for _, video := range data.Output.Videos {
+		addresses = append(addresses, model.Address{
+			Subfolder: video.Subfolder,
+			Filename:  video.Filename,
+			Type:      video.Type,
+		})
 	}
 
 	LogMessageWorker("[Executed] prompt_id: %s node: %s 生成结果数量: %d",
 		data.PromptID, data.Node, len(addresses))
 
-	// ✅ 通知上层任务完成
+	// ✅ 交给上层按 prompt_id 收集，execution_success 时统一完成
 	if w.notifier != nil {
-		LogMessageWorker("⚡️ 通知上层事务任务完成")
-		w.notifier.NotifyTaskDone(data.PromptID, addresses)
+		w.notifier.NotifyNodeOutput(data.PromptID, data.Node, addresses)
 	}
 
 }
 
 func (w *MessageWorker) handleProgressState(data ProgressStateData) {
+	event := ProgressEvent{
+		Type:     EventProgressState,
+		PromptID: data.PromptID,
+	}
 	for nodeID, node := range data.Nodes {
 		LogMessageWorker("[ProgressState] prompt_id: %s node: %s 进度: %d/%d 状态: %s",
 			data.PromptID, nodeID, node.Value, node.Max, node.State)
+		switch node.State {
+		case "finished":
+			event.Nodes = append(event.Nodes, nodeID)
+		case "running":
+			event.Node, event.Value, event.Max = nodeID, node.Value, node.Max
+		}
 	}
+	w.notifyProgress(event)
 }
 
 func (w *MessageWorker) handleImpactNodeFeedback(data ImpactNodeFeedbackData) {
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"farshore.ai/fast-comfy-api/config"
+)
+
+/*
+
+基于 /object_info 的能力路由
+
+不同节点安装的自定义节点不同（如只有部分节点安装了 VHS），
+健康检查成功后后台拉取节点的 GET /object_info，记录节点支持的 class_type 集合，
+每 config.ObjectInfoRefreshInterval 秒以及节点从熔断中恢复时重新拉取（节点重启后可能装了新插件）
+
+调度时只选择支持 prompt 中全部 class_type 的节点；尚未拉取成功的节点视为未知，不做过滤
+*/
+
+// nodeCapabilities 节点支持的 class_type
+type nodeCapabilities struct {
+	mu        sync.Mutex
+	classes   map[string]struct{}
+	updatedAt time.Time
+	lastError string
+	fetching  atomic.Bool
+}
+
+// NodeCapabilities 节点能力（节点状态接口中展示）
+type NodeCapabilities struct {
+	NodeClasses int       `json:"node_classes"` // 支持的 class_type 数量
+	UpdatedAt   time.Time `json:"updated_at"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// missingClasses 返回节点缺少的 class_type，ok 为 false 表示尚未拉取到 /object_info
+func (n *ComfyNode) missingClasses(classTypes []string) (missing []string, ok bool) {
+	n.capabilities.mu.Lock()
+	defer n.capabilities.mu.Unlock()
+	if n.capabilities.classes == nil {
+		return nil, false
+	}
+	for _, classType := range classTypes {
+		if _, ok := n.capabilities.classes[classType]; !ok {
+			missing = append(missing, classType)
+		}
+	}
+	return missing, true
+}
+
+// capabilityStatus 节点能力状态，从未拉取过时返回 false
+func (n *ComfyNode) capabilityStatus() (NodeCapabilities, bool) {
+	n.capabilities.mu.Lock()
+	defer n.capabilities.mu.Unlock()
+	if n.capabilities.classes == nil && n.capabilities.lastError == "" {
+		return NodeCapabilities{}, false
+	}
+	return NodeCapabilities{
+		NodeClasses: len(n.capabilities.classes),
+		UpdatedAt:   n.capabilities.updatedAt,
+		LastError:   n.capabilities.lastError,
+	}, true
+}
+
+// capabilitiesStale 是否需要重新拉取 /object_info
+func (n *ComfyNode) capabilitiesStale() bool {
+	n.capabilities.mu.Lock()
+	defer n.capabilities.mu.Unlock()
+	return n.capabilities.classes == nil || time.Since(n.capabilities.updatedAt) > config.ObjectInfoRefreshInterval*time.Second
+}
+
+// refreshCapabilities 后台拉取节点的 /object_info，同一节点同时只有一个拉取
+func (r *NodeRegistry) refreshCapabilities(node *ComfyNode) {
+	if !node.capabilities.fetching.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer node.capabilities.fetching.Store(false)
+		classes, err := r.fetchObjectInfo(node.URL)
+
+		node.capabilities.mu.Lock()
+		defer node.capabilities.mu.Unlock()
+		if err != nil {
+			// 拉取失败时保留上一次的结果
+			node.capabilities.lastError = err.Error()
+			LogAPIRuntime(ColorYellow+"[NodeRegistry] 节点 %s 获取 /object_info 失败: %s", node.Name, err)
+			return
+		}
+		node.capabilities.classes = classes
+		node.capabilities.updatedAt = time.Now()
+		node.capabilities.lastError = ""
+		LogAPIRuntime("[NodeRegistry] 节点 %s 支持 %d 种节点类型", node.Name, len(classes))
+	}()
+}
+
+// fetchObjectInfo 请求 GET /object_info，只解析顶层的 class_type
+func (r *NodeRegistry) fetchObjectInfo(host string) (map[string]struct{}, error) {
+	resp, err := r.objectInfoClient.Get(host + "/object_info")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("/object_info returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var info map[string]json.RawMessage
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("/object_info returned invalid json: %w", err)
+	}
+	classes := make(map[string]struct{}, len(info))
+	for classType := range info {
+		classes[classType] = struct{}{}
+	}
+	return classes, nil
+}
+
+// filterByCapabilities 过滤不支持 prompt 中全部 class_type 的节点
+func filterByCapabilities(nodes []*ComfyNode, classTypes []string) []*ComfyNode {
+	result := make([]*ComfyNode, 0, len(nodes))
+	key := "capabilities/" + strings.Join(classTypes, ",")
+	for _, node := range nodes {
+		missing, _ := node.missingClasses(classTypes)
+		// 调度每秒都会检查，只在缺少的节点类型变化时打印日志
+		if reason := strings.Join(missing, ", "); node.filtered.changed(key, reason) {
+			if reason != "" {
+				LogAPIRuntime(ColorYellow+"[GetBestServer] 节点 %s 缺少节点类型 %s，跳过", node.Name, reason)
+			} else {
+				LogAPIRuntime(ColorGreen+"[GetBestServer] 节点 %s 已支持全部节点类型，恢复参与调度", node.Name)
+			}
+		}
+		if len(missing) > 0 {
+			continue
+		}
+		result = append(result, node)
+	}
+	return result
+}
+
+// CapabilityWarning 本 API 没有任何节点能运行其 prompt 时返回提示，节点能力未知时不提示
+func (api *APIRuntime) CapabilityWarning() string {
+	classTypes := api.apiparser.GetClassTypes()
+	reasons := make([]string, 0, len(api.nodes))
+	for _, node := range api.nodes {
+		missing, ok := node.missingClasses(classTypes)
+		if !ok || len(missing) == 0 {
+			return ""
+		}
+		reasons = append(reasons, fmt.Sprintf("%s 缺少 %s", node.Name, strings.Join(missing, ", ")))
+	}
+	if len(reasons) == 0 {
+		return ""
+	}
+	return "没有节点支持本 API 的全部节点类型: " + strings.Join(reasons, "; ")
+}
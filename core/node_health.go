@@ -0,0 +1,233 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"farshore.ai/fast-comfy-api/config"
+	"farshore.ai/fast-comfy-api/utils"
+)
+
+/*
+
+节点健康检查与熔断
+
+后台定期探测每个节点的 GET /system_stats 与 GET /prompt：
+- closed    : 正常参与调度，连续失败 config.HealthFailureThreshold 次后熔断（open）
+- open      : 不参与调度，也不探测，等待 config.HealthOpenDuration 后进入 half_open
+- half_open : 不参与调度，探测一次：成功则恢复为 closed 重新参与调度，失败则重新 open
+*/
+
+// CircuitState 熔断状态
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// nodeHealth 节点健康状态
+type nodeHealth struct {
+	mu          sync.Mutex
+	state       CircuitState
+	failures    int // 连续失败次数
+	lastError   string
+	lastCheck   time.Time
+	lastSuccess time.Time
+	openedAt    time.Time
+	latency     time.Duration // 最近一次成功探测耗时
+}
+
+// NodeStatus 节点状态（节点状态接口与 /api/list 中展示）
+type NodeStatus struct {
+	Name        string       `json:"name"`
+	URL         string       `json:"url"`
+	Labels      []string     `json:"labels"`
+	Capacity    int          `json:"capacity"`
+	InFlight    int          `json:"in_flight"` // 网关在该节点上未结束的任务数
+	Healthy     bool         `json:"healthy"`   // 是否参与调度
+	Drained     bool         `json:"drained"`   // 是否排空中（不再分配新任务）
+	Circuit     CircuitState `json:"circuit"`
+	Failures    int          `json:"consecutive_failures"`
+	LastError   string       `json:"last_error,omitempty"`
+	LastCheck   time.Time    `json:"last_check"`
+	LastSuccess time.Time    `json:"last_success"`
+	OpenedAt    *time.Time   `json:"opened_at,omitempty"`
+	LatencyMs   int64        `json:"latency_ms"`
+
+	Telemetry    *NodeTelemetry    `json:"telemetry,omitempty"`    // crystools.monitor 最新数据，未上报时为空
+	Capabilities *NodeCapabilities `json:"capabilities,omitempty"` // /object_info 中支持的节点类型，尚未拉取时为空
+	LastRun      *NodeAffinity     `json:"last_run,omitempty"`     // 最近一次提交的 API 与模型
+}
+
+// Healthy 节点是否可以参与调度
+func (n *ComfyNode) Healthy() bool {
+	n.health.mu.Lock()
+	defer n.health.mu.Unlock()
+	return n.health.state == CircuitClosed
+}
+
+// status 构造节点状态
+func (n *ComfyNode) status(inFlight int) NodeStatus {
+	n.health.mu.Lock()
+	defer n.health.mu.Unlock()
+	status := NodeStatus{
+		Name:        n.Name,
+		URL:         n.URL,
+		Labels:      n.Labels,
+		Capacity:    n.Capacity,
+		InFlight:    inFlight,
+		Healthy:     n.health.state == CircuitClosed,
+		Drained:     n.drained.Load(),
+		Circuit:     n.health.state,
+		Failures:    n.health.failures,
+		LastError:   n.health.lastError,
+		LastCheck:   n.health.lastCheck,
+		LastSuccess: n.health.lastSuccess,
+		LatencyMs:   n.health.latency.Milliseconds(),
+	}
+	if n.health.state != CircuitClosed {
+		openedAt := n.health.openedAt
+		status.OpenedAt = &openedAt
+	}
+	if telemetry, ok := n.telemetry(); ok {
+		status.Telemetry = &telemetry
+	}
+	if capabilities, ok := n.capabilityStatus(); ok {
+		status.Capabilities = &capabilities
+	}
+	if lastRun, ok := n.lastRun(); ok {
+		status.LastRun = &lastRun
+	}
+	return status
+}
+
+// NodeStatuses 返回所有节点状态
+func (r *NodeRegistry) NodeStatuses() []NodeStatus {
+	inFlight := r.InFlight()
+	list := []NodeStatus{}
+	for _, node := range r.Nodes() {
+		list = append(list, node.status(inFlight[node.URL]))
+	}
+	return list
+}
+
+// NodeStatus 根据名称查询节点状态
+func (r *NodeRegistry) NodeStatus(name string) (NodeStatus, bool) {
+	r.mu.Lock()
+	node, ok := r.byName[name]
+	r.mu.Unlock()
+	if !ok {
+		return NodeStatus{}, false
+	}
+	return node.status(r.InFlight()[node.URL]), true
+}
+
+// healthLoop 后台健康检查协程
+func (r *NodeRegistry) healthLoop() {
+	r.checkAll()
+	ticker := time.NewTicker(config.HealthCheckInterval * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.checkAll()
+	}
+}
+
+// checkAll 并发探测所有节点
+func (r *NodeRegistry) checkAll() {
+	var wg sync.WaitGroup
+	for _, node := range r.Nodes() {
+		wg.Add(1)
+		go func(node *ComfyNode) {
+			defer wg.Done()
+			r.check(node)
+		}(node)
+	}
+	wg.Wait()
+}
+
+// check 探测单个节点并推进熔断状态
+func (r *NodeRegistry) check(node *ComfyNode) {
+	node.health.mu.Lock()
+	if node.health.state == CircuitOpen {
+		if time.Since(node.health.openedAt) < config.HealthOpenDuration*time.Second {
+			node.health.mu.Unlock()
+			return
+		}
+		node.health.state = CircuitHalfOpen
+		LogAPIRuntime(ColorYellow+"[HealthCheck] 节点 %s 进入半开状态，尝试探测", node.Name)
+	}
+	node.health.mu.Unlock()
+
+	start := time.Now()
+	err := r.probe(node.URL)
+	latency := time.Since(start)
+
+	node.health.mu.Lock()
+	previous := node.health.state
+	node.health.lastCheck = time.Now()
+	if err == nil {
+		node.health.failures = 0
+		node.health.lastError = ""
+		node.health.lastSuccess = node.health.lastCheck
+		node.health.latency = latency
+		node.health.state = CircuitClosed
+	} else {
+		node.health.failures++
+		node.health.lastError = err.Error()
+		if previous == CircuitHalfOpen || node.health.failures >= config.HealthFailureThreshold {
+			node.health.state = CircuitOpen
+			node.health.openedAt = node.health.lastCheck
+		}
+	}
+	current := node.health.state
+	failures := node.health.failures
+	node.health.mu.Unlock()
+
+	// 节点可达时拉取 / 定期刷新支持的节点类型，节点恢复时可能已重启并安装了新插件
+	if err == nil && (previous != CircuitClosed || node.capabilitiesStale()) {
+		r.refreshCapabilities(node)
+	}
+
+	switch {
+	case previous != CircuitClosed && current == CircuitClosed:
+		LogAPIRuntime(ColorGreen+"[HealthCheck] 节点 %s 已恢复，重新参与调度", node.Name)
+		// WebSocket 重连次数耗尽后不会再自动重连，节点恢复时重新建立连接
+		r.Reconnect(node)
+		r.signalCapacity()
+	case previous == CircuitClosed && current == CircuitOpen:
+		warn_log := fmt.Sprintf(" %s 节点连续 %d 次健康检查失败，已暂停调度: %s", node.Name, failures, err)
+		LogAPIRuntime(ColorRed + "[HealthCheck]" + warn_log)
+		utils.Feishu.InternalFeishuWarning("node_unhealthy", node.URL, warn_log)
+		r.NotifyConnectionLost(node.URL)
+	case err != nil:
+		LogAPIRuntime(ColorYellow+"[HealthCheck] 节点 %s 健康检查失败(连续 %d 次): %s", node.Name, failures, err)
+	}
+}
+
+// probe 请求 /system_stats 与 /prompt，两者都返回 200 且为合法 JSON 才视为健康
+func (r *NodeRegistry) probe(host string) error {
+	for _, path := range []string{"/system_stats", "/prompt"} {
+		resp, err := r.healthClient.Get(host + path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned status %d", path, resp.StatusCode)
+		}
+		if !json.Valid(body) {
+			return fmt.Errorf("%s returned invalid json", path)
+		}
+	}
+	return nil
+}
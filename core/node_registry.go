@@ -0,0 +1,377 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"farshore.ai/fast-comfy-api/config"
+	"farshore.ai/fast-comfy-api/model"
+)
+
+/*
+
+全局 ComfyUI 节点注册表
+
+节点在 config.yaml 的 comfyui.nodes 中统一声明（名称、标签、容量），
+API 配置的 comfyui_nodes 通过节点名称或标签引用，也兼容直接填写地址
+
+每个节点只建立一条 WebSocket 连接，所有 API 共用：
+MessageWorker -> NodeRegistry（按 prompt_id 查找所属 API）-> APIRuntime
+*/
+
+// ComfyNode 一个 ComfyUI 节点
+type ComfyNode struct {
+	Name     string   `json:"name"`
+	URL      string   `json:"url"`
+	Labels   []string `json:"labels"`
+	Capacity int      `json:"capacity"`
+
+	worker       *MessageWorker   // 共享的 WebSocket 消息消费者，首次被 API 使用时建立
+	health       nodeHealth       // 健康检查与熔断状态
+	resources    nodeTelemetry    // crystools.monitor 上报的资源数据
+	affinity     nodeAffinity     // 最近一次运行的模型，用于模型亲和调度
+	capabilities nodeCapabilities // /object_info 中支持的节点类型，用于能力路由
+	drained      atomic.Bool      // 排空中：不再分配新任务，已提交的任务正常完成
+	filtered     filterState      // 最近一次调度过滤的结果，用于只在变化时打印日志
+}
+
+// filterState 节点在各过滤条件下最近一次的结果，调度每秒都会检查，只在结果变化时打印日志
+type filterState struct {
+	mu      sync.Mutex
+	reasons map[string]string // 过滤条件 -> 跳过原因，空字符串表示未被过滤
+}
+
+// changed 记录过滤结果，与上一次不同时返回 true
+func (f *filterState) changed(key, reason string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reasons[key] == reason {
+		return false
+	}
+	if f.reasons == nil {
+		f.reasons = make(map[string]string)
+	}
+	f.reasons[key] = reason
+	return true
+}
+
+// promptOwner prompt 的归属
+type promptOwner struct {
+	host     string
+	notifier TaskNotifier
+}
+
+// NodeRegistry 节点注册表，同时作为所有节点 MessageWorker 的 TaskNotifier，按 prompt_id 分发事件
+type NodeRegistry struct {
+	clientID string
+	mu       sync.Mutex
+	nodes    []*ComfyNode          // 按声明顺序
+	byName   map[string]*ComfyNode // 名称 -> 节点
+	byURL    map[string]*ComfyNode // normalizeHost(url) -> 节点
+	owners   sync.Map              // prompt_id -> *promptOwner
+
+	reserveMu sync.Mutex
+	reserved  map[string]int // 已选中但尚未提交完成的数量，url -> count
+
+	capacityMu sync.Mutex
+	capacityCh chan struct{} // 节点释放容量时关闭并替换，唤醒各 API 的网关队列
+
+	healthClient     *http.Client // 健康检查使用的 http 客户端
+	objectInfoClient *http.Client // 拉取 /object_info 使用的 http 客户端
+
+	maxVRAMPercent float64 // 显存使用率超过该值的节点暂不接收新任务，0 表示不限制
+	maxGPUTemp     int     // GPU 温度超过该值的节点暂不接收新任务，0 表示不限制
+
+	defaultCapacity int // 未配置 capacity 的节点（包括直接填写地址的节点）的容量
+}
+
+func NewNodeRegistry(cfg model.ComfyUIConfig) *NodeRegistry {
+	registry := &NodeRegistry{
+		clientID: cfg.ClientID,
+		byName:   make(map[string]*ComfyNode),
+		byURL:    make(map[string]*ComfyNode),
+		reserved: make(map[string]int),
+
+		capacityCh: make(chan struct{}),
+
+		healthClient:     &http.Client{Timeout: config.HealthCheckTimeout * time.Second},
+		objectInfoClient: &http.Client{Timeout: config.ObjectInfoTimeout * time.Second},
+
+		maxVRAMPercent: cfg.MaxVRAMPercent,
+		maxGPUTemp:     cfg.MaxGPUTemp,
+
+		defaultCapacity: cfg.DefaultCapacity,
+	}
+	if registry.clientID == "" {
+		registry.clientID = config.DefaultClientID
+	}
+	if registry.defaultCapacity <= 0 {
+		registry.defaultCapacity = config.DefaultNodeCapacity
+	}
+	for _, node := range cfg.Nodes {
+		if node.Name == "" || node.URL == "" {
+			LogAPIRuntime(ColorRed+"[NodeRegistry] 节点缺少 name 或 url，已忽略: %+v", node)
+			continue
+		}
+		if _, exists := registry.byName[node.Name]; exists {
+			LogAPIRuntime(ColorRed+"[NodeRegistry] 节点名称重复，已忽略: %s", node.Name)
+			continue
+		}
+		registry.add(node.Name, node.URL, node.Labels, node.Capacity)
+	}
+	LogAPIRuntime("[NodeRegistry] 注册 %d 个节点, clientId: %s", len(registry.nodes), registry.clientID)
+	go registry.healthLoop()
+	return registry
+}
+
+// add 注册节点（调用方负责加锁）
+func (r *NodeRegistry) add(name, nodeURL string, labels []string, capacity int) *ComfyNode {
+	if capacity <= 0 {
+		capacity = r.defaultCapacity
+	}
+	node := &ComfyNode{
+		Name:     name,
+		URL:      strings.TrimRight(nodeURL, "/"),
+		Labels:   labels,
+		Capacity: capacity,
+	}
+	node.health.state = CircuitClosed
+	r.nodes = append(r.nodes, node)
+	r.byName[name] = node
+	r.byURL[normalizeHost(node.URL)] = node
+	return node
+}
+
+// addressName 未声明的地址以 host:port 作为节点名称（可以出现在 /api/nodes/:name 路径中），与已有名称冲突时加序号（调用方负责加锁）
+func (r *NodeRegistry) addressName(ref string) string {
+	host := normalizeHost(ref)
+	name := host
+	for i := 2; ; i++ {
+		if _, exists := r.byName[name]; !exists {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", host, i)
+	}
+}
+
+// ClientID 提交 prompt 时使用的 clientId，与共享 WebSocket 连接一致
+func (r *NodeRegistry) ClientID() string {
+	return r.clientID
+}
+
+// Resolve 将 API 配置中的节点引用解析为节点列表（去重并保持顺序）
+// 引用可以是节点名称、标签，或者 http(s):// 开头的地址（未声明的地址会临时注册为节点）
+func (r *NodeRegistry) Resolve(refs []string) ([]*ComfyNode, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var nodes []*ComfyNode
+	appendNode := func(node *ComfyNode) {
+		if !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	for _, ref := range refs {
+		if node, ok := r.byName[ref]; ok {
+			appendNode(node)
+			continue
+		}
+		matched := false
+		for _, node := range r.nodes {
+			if slices.Contains(node.Labels, ref) {
+				appendNode(node)
+				matched = true
+			}
+		}
+		if matched {
+			continue
+		}
+		if strings.Contains(ref, "://") {
+			node, ok := r.byURL[normalizeHost(ref)]
+			if !ok {
+				node = r.add(r.addressName(ref), ref, nil, 0)
+			}
+			appendNode(node)
+			continue
+		}
+		return nil, fmt.Errorf("unknown comfyui node or label: %s", ref)
+	}
+	return nodes, nil
+}
+
+// Connect 建立节点的共享 WebSocket 连接，已连接时直接返回
+func (r *NodeRegistry) Connect(node *ComfyNode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if node.worker != nil {
+		return nil
+	}
+	worker := NewMessageWorker(normalizeHost(node.URL), r.clientID, r)
+	if err := worker.Start(); err != nil {
+		return err
+	}
+	node.worker = worker
+	return nil
+}
+
+// Reconnect 重新建立节点的共享 WebSocket 连接（从未连接过的节点不处理）
+func (r *NodeRegistry) Reconnect(node *ComfyNode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if node.worker == nil {
+		return
+	}
+	node.worker.Stop()
+	worker := NewMessageWorker(normalizeHost(node.URL), r.clientID, r)
+	if err := worker.Start(); err != nil {
+		LogAPIRuntime(ColorRed+"[NodeRegistry] 节点 %s 重新连接失败: %s", node.Name, err)
+		node.worker = nil
+		return
+	}
+	node.worker = worker
+}
+
+// SetDrained 排空 / 恢复节点，状态保存在全局注册表中，API 热重载后依然有效
+func (r *NodeRegistry) SetDrained(name string, drained bool) (NodeStatus, bool) {
+	r.mu.Lock()
+	node, ok := r.byName[name]
+	r.mu.Unlock()
+	if !ok {
+		return NodeStatus{}, false
+	}
+	if node.drained.Swap(drained) != drained {
+		if drained {
+			LogAPIRuntime(ColorYellow+"[NodeRegistry] 节点 %s 开始排空，不再分配新任务", node.Name)
+		} else {
+			LogAPIRuntime(ColorGreen+"[NodeRegistry] 节点 %s 取消排空，恢复分配任务", node.Name)
+			r.signalCapacity()
+		}
+	}
+	return node.status(r.InFlight()[node.URL]), true
+}
+
+// Nodes 返回所有节点
+func (r *NodeRegistry) Nodes() []*ComfyNode {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.nodes)
+}
+
+// Get 根据地址获取节点
+func (r *NodeRegistry) Get(host string) (*ComfyNode, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	node, ok := r.byURL[normalizeHost(host)]
+	return node, ok
+}
+
+// Own 登记 prompt 的归属，之后该 prompt 的事件分发给 notifier
+func (r *NodeRegistry) Own(promptID, host string, notifier TaskNotifier) {
+	r.owners.Store(promptID, &promptOwner{host: host, notifier: notifier})
+}
+
+// Disown 注销 prompt 的归属（热重载后归属可能已转移，只注销属于 notifier 的）
+func (r *NodeRegistry) Disown(promptID string, notifier TaskNotifier) {
+	value, ok := r.owners.Load(promptID)
+	if ok && value.(*promptOwner).notifier == notifier && r.owners.CompareAndDelete(promptID, value) {
+		r.signalCapacity()
+	}
+}
+
+// owner 查找 prompt 所属的 notifier
+func (r *NodeRegistry) owner(promptID string) (TaskNotifier, bool) {
+	value, ok := r.owners.Load(promptID)
+	if !ok {
+		return nil, false
+	}
+	return value.(*promptOwner).notifier, true
+}
+
+// Release 释放预占的节点
+func (r *NodeRegistry) Release(host string) {
+	r.reserveMu.Lock()
+	defer r.reserveMu.Unlock()
+	if r.reserved[host] > 0 {
+		r.reserved[host]--
+	}
+	r.signalCapacity()
+}
+
+// CapacityChanged 返回一个通道，节点释放容量（任务结束、预占释放、恢复健康、取消排空）时关闭
+func (r *NodeRegistry) CapacityChanged() <-chan struct{} {
+	r.capacityMu.Lock()
+	defer r.capacityMu.Unlock()
+	return r.capacityCh
+}
+
+// signalCapacity 通知所有等待节点容量的网关队列
+func (r *NodeRegistry) signalCapacity() {
+	r.capacityMu.Lock()
+	defer r.capacityMu.Unlock()
+	close(r.capacityCh)
+	r.capacityCh = make(chan struct{})
+}
+
+// InFlight 统计每个节点上网关（所有 API）已提交尚未结束的 prompt 数量
+func (r *NodeRegistry) InFlight() map[string]int {
+	counts := make(map[string]int)
+	r.owners.Range(func(_, value interface{}) bool {
+		counts[value.(*promptOwner).host]++
+		return true
+	})
+	return counts
+}
+
+// ========================
+// TaskNotifier 实现：按 prompt_id 分发到所属 API
+// ========================
+
+func (r *NodeRegistry) NotifyTaskStart(promptID string) {
+	if notifier, ok := r.owner(promptID); ok {
+		notifier.NotifyTaskStart(promptID)
+	}
+}
+
+func (r *NodeRegistry) NotifyProgress(event ProgressEvent) {
+	if notifier, ok := r.owner(event.PromptID); ok {
+		notifier.NotifyProgress(event)
+	}
+}
+
+func (r *NodeRegistry) NotifyNodeOutput(promptID string, nodeID string, addresses []model.Address) {
+	if notifier, ok := r.owner(promptID); ok {
+		notifier.NotifyNodeOutput(promptID, nodeID, addresses)
+	}
+}
+
+func (r *NodeRegistry) NotifyTaskDone(promptID string) {
+	if notifier, ok := r.owner(promptID); ok {
+		notifier.NotifyTaskDone(promptID)
+	}
+}
+
+// NotifyConnectionLost 通知所有在该节点上有任务的 API
+func (r *NodeRegistry) NotifyConnectionLost(host string) {
+	notifiers := map[TaskNotifier]struct{}{}
+	r.owners.Range(func(_, value interface{}) bool {
+		owner := value.(*promptOwner)
+		if normalizeHost(owner.host) == normalizeHost(host) {
+			notifiers[owner.notifier] = struct{}{}
+		}
+		return true
+	})
+	for notifier := range notifiers {
+		notifier.NotifyConnectionLost(host)
+	}
+}
+
+func (r *NodeRegistry) NotifyTaskFailed(promptID string, err *ExecutionError) {
+	if notifier, ok := r.owner(promptID); ok {
+		notifier.NotifyTaskFailed(promptID, err)
+	}
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"farshore.ai/fast-comfy-api/config"
+)
+
+/*
+
+基于 crystools.monitor 的资源感知调度
+
+MessageWorker 收到 crystools.monitor 消息后交给 NodeRegistry 记录每个节点最新的 GPU 温度与显存，
+GetBestServer 在调度前过滤（均为可选，默认不限制）：
+- GPU 温度超过 comfyui.max_gpu_temp 的节点
+- 显存使用率超过 comfyui.max_vram_percent 的节点
+- 空闲显存低于 API 配置 min_free_vram_mb 的节点（已加载本次所需模型的热节点除外，模型常驻显存时空闲显存本来就少）
+被过滤的节点只是暂不接收新任务，请求留在网关队列中等待，不会因此失败
+配置了 min_free_vram_mb 的 API 视为重负载工作流，其余条件相同时优先空闲显存多的节点
+
+未安装 crystools 或超过 config.TelemetryMaxAge 秒未上报的节点不做资源过滤；多卡节点按第一张卡（ComfyUI 默认设备）计算
+*/
+
+// TelemetryReceiver 接收节点资源监控数据（可选实现，MessageWorker 的 notifier 实现该接口时转发）
+type TelemetryReceiver interface {
+	NotifyMonitor(host string, data MonitorData)
+}
+
+// nodeTelemetry 节点最新的资源数据
+type nodeTelemetry struct {
+	mu        sync.Mutex
+	gpuTemp   int
+	vramUsed  int64 // 字节
+	vramTotal int64 // 字节
+	updatedAt time.Time
+}
+
+// NodeTelemetry 节点资源数据（节点状态接口中展示）
+type NodeTelemetry struct {
+	GPUTemp         int       `json:"gpu_temperature"`
+	VRAMUsedPercent float64   `json:"vram_used_percent"`
+	FreeVRAMMB      int64     `json:"free_vram_mb"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// telemetry 返回未过期的资源数据
+func (n *ComfyNode) telemetry() (NodeTelemetry, bool) {
+	n.resources.mu.Lock()
+	defer n.resources.mu.Unlock()
+	if n.resources.updatedAt.IsZero() || time.Since(n.resources.updatedAt) > config.TelemetryMaxAge*time.Second || n.resources.vramTotal <= 0 {
+		return NodeTelemetry{}, false
+	}
+	return NodeTelemetry{
+		GPUTemp:         n.resources.gpuTemp,
+		VRAMUsedPercent: float64(n.resources.vramUsed) / float64(n.resources.vramTotal) * 100,
+		FreeVRAMMB:      (n.resources.vramTotal - n.resources.vramUsed) / 1024 / 1024,
+		UpdatedAt:       n.resources.updatedAt,
+	}, true
+}
+
+// NotifyMonitor 记录节点资源数据
+func (r *NodeRegistry) NotifyMonitor(host string, data MonitorData) {
+	if len(data.GPUs) == 0 {
+		return
+	}
+	node, ok := r.Get(host)
+	if !ok {
+		return
+	}
+	gpu := data.GPUs[0]
+	node.resources.mu.Lock()
+	node.resources.gpuTemp = gpu.GPUTemperature
+	node.resources.vramUsed = gpu.VRAMUsed
+	node.resources.vramTotal = gpu.VRAMTotal
+	node.resources.updatedAt = time.Now()
+	node.resources.mu.Unlock()
+}
+
+// filterByResources 过滤资源不满足要求的节点；minFreeVRAM > 0 时按空闲显存从多到少排序（稳定排序，作为调度策略的平局优先级）
+// warm 判断节点是否已加载所需模型，热节点不检查 minFreeVRAM
+func (r *NodeRegistry) filterByResources(nodes []*ComfyNode, minFreeVRAM int64, warm func(*ComfyNode) bool) []*ComfyNode {
+	free := make(map[*ComfyNode]int64, len(nodes))
+	result := make([]*ComfyNode, 0, len(nodes))
+	key := fmt.Sprintf("resources/%d", minFreeVRAM)
+	for _, node := range nodes {
+		telemetry, ok := node.telemetry()
+		if !ok {
+			if node.filtered.changed(key, "") {
+				LogAPIRuntime(ColorGreen+"[GetBestServer] 节点 %s 资源数据未知，恢复参与调度", node.Name)
+			}
+			free[node] = -1 // 未知，排在有数据的节点之后
+			result = append(result, node)
+			continue
+		}
+		// 原因只记录类别，数值每秒都在变化，只在类别变化时打印日志
+		reason, detail := "", ""
+		switch {
+		case r.maxGPUTemp > 0 && telemetry.GPUTemp > r.maxGPUTemp:
+			reason, detail = "gpu_temp", fmt.Sprintf("GPU 温度 %d°C 超过阈值 %d°C", telemetry.GPUTemp, r.maxGPUTemp)
+		case r.maxVRAMPercent > 0 && telemetry.VRAMUsedPercent > r.maxVRAMPercent:
+			reason, detail = "vram_percent", fmt.Sprintf("显存使用率 %.1f%% 超过阈值 %.1f%%", telemetry.VRAMUsedPercent, r.maxVRAMPercent)
+		case minFreeVRAM > 0 && telemetry.FreeVRAMMB < minFreeVRAM && !warm(node):
+			reason, detail = "min_free_vram", fmt.Sprintf("空闲显存 %d MB 低于要求 %d MB", telemetry.FreeVRAMMB, minFreeVRAM)
+		}
+		if node.filtered.changed(key, reason) {
+			if reason != "" {
+				LogAPIRuntime(ColorYellow+"[GetBestServer] 节点 %s %s，暂停调度", node.Name, detail)
+			} else {
+				LogAPIRuntime(ColorGreen+"[GetBestServer] 节点 %s 资源恢复，恢复参与调度", node.Name)
+			}
+		}
+		if reason != "" {
+			continue
+		}
+		free[node] = telemetry.FreeVRAMMB
+		result = append(result, node)
+	}
+	if minFreeVRAM > 0 {
+		slices.SortStableFunc(result, func(a, b *ComfyNode) int {
+			switch {
+			case free[a] > free[b]:
+				return -1
+			case free[a] < free[b]:
+				return 1
+			}
+			return 0
+		})
+	}
+	return result
+}
@@ -19,7 +19,17 @@ type PromptCommitResponse struct {
 	Number     int                    `json:"number,omitempty"`
 }
 
-// PromptCommit 提交 prompt，如果有prompt_id，返回prompt_id
+// PromptRejectedError ComfyUI 校验 prompt 失败（HTTP 4xx，如 node_errors），换节点重试也不会成功
+type PromptRejectedError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *PromptRejectedError) Error() string {
+	return fmt.Sprintf("failed to generate prompt: %s", e.Body)
+}
+
+// PromptCommit 提交 prompt，如果有prompt_id，返回prompt_id；4xx 响应返回 *PromptRejectedError
 func PromptCommit(host string, prompt map[string]model.PromptNode, clientID string) (string, error) {
 	fullURL := fmt.Sprintf("%s/prompt", strings.TrimRight(host, "/"))
 	body := map[string]interface{}{
@@ -50,6 +60,9 @@ func PromptCommit(host string, prompt map[string]model.PromptNode, clientID stri
 		return "", fmt.Errorf("failed to read response: %w", err)
 	}
 
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return "", &PromptRejectedError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
 	if resp.StatusCode != http.StatusOK {
 		return "", fmt.Errorf("failed to generate prompt: %s", string(respBody))
 	}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// QueueResponse ComfyUI GET /queue 返回结构，每一项为 [number, prompt_id, prompt, extra_data, outputs_to_execute]
+type QueueResponse struct {
+	QueueRunning [][]interface{} `json:"queue_running"`
+	QueuePending [][]interface{} `json:"queue_pending"`
+}
+
+// GetComfyuiQueue 获取节点当前执行中 / 排队中的 prompt_id 列表
+func GetComfyuiQueue(host string) (running []string, pending []string, err error) {
+	fullURL := fmt.Sprintf("%s/queue", strings.TrimRight(host, "/"))
+	resp, err := http.Get(fullURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("请求 queue 接口失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("queue 接口返回状态码 %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取 queue 响应失败: %w", err)
+	}
+
+	var queue QueueResponse
+	if err := json.Unmarshal(body, &queue); err != nil {
+		return nil, nil, fmt.Errorf("解析 queue 响应失败: %w", err)
+	}
+	return queuePromptIDs(queue.QueueRunning), queuePromptIDs(queue.QueuePending), nil
+}
+
+// queuePromptIDs 提取队列项中的 prompt_id
+func queuePromptIDs(items [][]interface{}) []string {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		if len(item) < 2 {
+			continue
+		}
+		if id, ok := item[1].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// DeleteFromQueue 从节点排队队列中删除 prompt
+func DeleteFromQueue(host, promptID string) error {
+	return postComfyuiJSON(host, "/queue", map[string]interface{}{
+		"delete": []string{promptID},
+	})
+}
+
+// InterruptPrompt 中断节点上正在执行的 prompt
+func InterruptPrompt(host, promptID string) error {
+	return postComfyuiJSON(host, "/interrupt", map[string]interface{}{
+		"prompt_id": promptID,
+	})
+}
+
+// postComfyuiJSON 向 ComfyUI 发送 JSON POST 请求
+func postComfyuiJSON(host, path string, body interface{}) error {
+	fullURL := fmt.Sprintf("%s%s", strings.TrimRight(host, "/"), path)
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal body: %w", err)
+	}
+
+	resp, err := http.Post(fullURL, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s returned status %d: %s", path, resp.StatusCode, string(respBody))
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log"
@@ -157,6 +158,28 @@ func detectContentType(filePath string) string {
 	return http.DetectContentType(buffer[:n])
 }
 
+// 辅助函数 detectDataContentType 识别调用方上传 / 远程下载的文件类型
+// 与 detectContentType 相反，以文件头为准（扩展名由调用方决定，不可信），文件头无法识别时才参考扩展名
+func detectDataContentType(filename string, data []byte) string {
+	contentType := http.DetectContentType(data[:min(len(data), 512)])
+	if contentType != "application/octet-stream" {
+		return contentType
+	}
+	// http.DetectContentType 不识别 FLAC 以及不带 ID3 标签的 MP3
+	switch {
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return "audio/flac"
+	case len(data) >= 2 && data[0] == 0xFF && data[1]&0xE6 == 0xE2:
+		return "audio/mpeg"
+	}
+	if ext := filepath.Ext(filename); ext != "" {
+		if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+			return mimeType
+		}
+	}
+	return contentType
+}
+
 // 辅助函数 BuildPublicURL 构建公有访问 URL
 func (s *S3Client) BuildPublicURL(key string) string {
 	endpoint := strings.TrimSuffix(s.Config.Endpoint, "/")
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+)
+
+/*
+
+节点调度策略
+
+每个 API 可在配置 JSON 中通过 scheduler 字段选择调度策略，不填默认 least_queue：
+- least_queue     : 查询所有节点 GET /prompt 的队列数量，选择排队最少的节点
+- round_robin     : 按配置顺序轮询
+- weighted_random : 按 node_weights 中的权重随机选择，未配置的节点权重为 1，权重为 0 的节点不参与
+- least_in_flight : 选择网关自身在该节点上未完成的 prompt 最少的节点，不请求 ComfyUI
+*/
+
+const (
+	SchedulerLeastQueue     = "least_queue"
+	SchedulerRoundRobin     = "round_robin"
+	SchedulerWeightedRandom = "weighted_random"
+	SchedulerLeastInFlight  = "least_in_flight"
+)
+
+// NodeStats 调度时可用的节点信息
+type NodeStats struct {
+	Queue    map[string]int // 节点 GET /prompt 的队列数量，仅在 NeedQueue 为 true 时填充，查询失败的节点不在其中
+	Reserved map[string]int // 已选中但尚未提交完成的数量
+	InFlight map[string]int // 网关（所有 API）已提交尚未结束的 prompt 数量（包含 Reserved）
+	Capacity map[string]int // 节点容量
+}
+
+// Scheduler 节点调度策略
+type Scheduler interface {
+	Name() string
+	// NeedQueue 是否需要实时查询节点队列数量
+	NeedQueue() bool
+	// Pick 从 nodes 中选择一个节点，没有可用节点时返回空字符串
+	Pick(nodes []string, stats NodeStats) string
+}
+
+// NewScheduler 根据名称创建调度策略
+func NewScheduler(name string, weights map[string]int) (Scheduler, error) {
+	switch name {
+	case "", SchedulerLeastQueue:
+		return &leastQueueScheduler{}, nil
+	case SchedulerRoundRobin:
+		return &roundRobinScheduler{}, nil
+	case SchedulerWeightedRandom:
+		return &weightedRandomScheduler{weights: weights}, nil
+	case SchedulerLeastInFlight:
+		return &leastInFlightScheduler{}, nil
+	}
+	return nil, fmt.Errorf("unknown scheduler: %s", name)
+}
+
+// 🫱🫱🫱 贪婪策略，任务抵达时，检查所有nodes的服务器的队列数量，选择最小队列数量（加上已选中尚未提交的数量）的node 作为最佳节点
+type leastQueueScheduler struct{}
+
+func (s *leastQueueScheduler) Name() string    { return SchedulerLeastQueue }
+func (s *leastQueueScheduler) NeedQueue() bool { return true }
+
+func (s *leastQueueScheduler) Pick(nodes []string, stats NodeStats) string {
+	min_queue := int(^uint(0) >> 1) // 最大值
+	best_node := ""
+	for _, node := range nodes {
+		queue, ok := stats.Queue[node]
+		if !ok {
+			continue
+		}
+		if load := queueLoad(queue, stats.Reserved[node]); load < min_queue {
+			min_queue = load
+			best_node = node
+		}
+	}
+	return best_node
+}
+
+// queueLoad 队列数量 + 预占数量，GetComfyuiServerQueue 查询异常时返回 int 最大值，相加需防止溢出
+func queueLoad(queue int, reserved int) int {
+	if queue > math.MaxInt-reserved {
+		return math.MaxInt
+	}
+	return queue + reserved
+}
+
+// 轮询策略
+type roundRobinScheduler struct {
+	next atomic.Uint64
+}
+
+func (s *roundRobinScheduler) Name() string    { return SchedulerRoundRobin }
+func (s *roundRobinScheduler) NeedQueue() bool { return false }
+
+func (s *roundRobinScheduler) Pick(nodes []string, stats NodeStats) string {
+	if len(nodes) == 0 {
+		return ""
+	}
+	index := (s.next.Add(1) - 1) % uint64(len(nodes))
+	return nodes[index]
+}
+
+// 加权随机策略
+type weightedRandomScheduler struct {
+	weights map[string]int // 节点 -> 权重，未配置默认为 1
+}
+
+func (s *weightedRandomScheduler) Name() string    { return SchedulerWeightedRandom }
+func (s *weightedRandomScheduler) NeedQueue() bool { return false }
+
+func (s *weightedRandomScheduler) weight(node string) int {
+	weight, ok := s.weights[node]
+	if !ok {
+		return 1
+	}
+	if weight < 0 {
+		return 0
+	}
+	return weight
+}
+
+func (s *weightedRandomScheduler) Pick(nodes []string, stats NodeStats) string {
+	total := 0
+	for _, node := range nodes {
+		total += s.weight(node)
+	}
+	if total == 0 {
+		return ""
+	}
+	n := rand.Intn(total)
+	for _, node := range nodes {
+		n -= s.weight(node)
+		if n < 0 {
+			return node
+		}
+	}
+	return ""
+}
+
+// 最少在途策略，只统计网关自己提交的 prompt，按节点容量折算负载，适合节点独占给网关使用的场景
+type leastInFlightScheduler struct{}
+
+func (s *leastInFlightScheduler) Name() string    { return SchedulerLeastInFlight }
+func (s *leastInFlightScheduler) NeedQueue() bool { return false }
+
+func (s *leastInFlightScheduler) Pick(nodes []string, stats NodeStats) string {
+	best_node := ""
+	min_load := math.MaxFloat64
+	for _, node := range nodes {
+		capacity := stats.Capacity[node]
+		if capacity <= 0 {
+			capacity = 1
+		}
+		if load := float64(stats.InFlight[node]) / float64(capacity); load < min_load {
+			min_load = load
+			best_node = node
+		}
+	}
+	return best_node
+}
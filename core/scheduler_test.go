@@ -0,0 +1,142 @@
+package core
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNewScheduler(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"", SchedulerLeastQueue, false},
+		{SchedulerLeastQueue, SchedulerLeastQueue, false},
+		{SchedulerRoundRobin, SchedulerRoundRobin, false},
+		{SchedulerWeightedRandom, SchedulerWeightedRandom, false},
+		{SchedulerLeastInFlight, SchedulerLeastInFlight, false},
+		{"random", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheduler, err := NewScheduler(tt.name, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewScheduler(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if err == nil && scheduler.Name() != tt.want {
+				t.Fatalf("NewScheduler(%q).Name() = %q, want %q", tt.name, scheduler.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerPick(t *testing.T) {
+	nodes := []string{"a", "b", "c"}
+	tests := []struct {
+		name      string
+		scheduler string
+		weights   map[string]int
+		nodes     []string
+		stats     NodeStats
+		want      string
+	}{
+		{
+			name:      "least queue picks shortest queue",
+			scheduler: SchedulerLeastQueue,
+			nodes:     nodes,
+			stats:     NodeStats{Queue: map[string]int{"a": 3, "b": 1, "c": 2}},
+			want:      "b",
+		},
+		{
+			name:      "least queue counts reserved",
+			scheduler: SchedulerLeastQueue,
+			nodes:     nodes,
+			stats:     NodeStats{Queue: map[string]int{"a": 1, "b": 0, "c": 2}, Reserved: map[string]int{"b": 2}},
+			want:      "a",
+		},
+		{
+			name:      "least queue skips nodes without queue",
+			scheduler: SchedulerLeastQueue,
+			nodes:     nodes,
+			stats:     NodeStats{Queue: map[string]int{"c": 5}},
+			want:      "c",
+		},
+		{
+			name:      "least queue saturates failed query",
+			scheduler: SchedulerLeastQueue,
+			nodes:     []string{"a", "b"},
+			stats:     NodeStats{Queue: map[string]int{"a": math.MaxInt, "b": 100}, Reserved: map[string]int{"a": 1}},
+			want:      "b",
+		},
+		{
+			name:      "least queue no queue data",
+			scheduler: SchedulerLeastQueue,
+			nodes:     nodes,
+			want:      "",
+		},
+		{
+			name:      "round robin first pick",
+			scheduler: SchedulerRoundRobin,
+			nodes:     nodes,
+			want:      "a",
+		},
+		{
+			name:      "round robin empty",
+			scheduler: SchedulerRoundRobin,
+			want:      "",
+		},
+		{
+			name:      "weighted random only positive weight",
+			scheduler: SchedulerWeightedRandom,
+			weights:   map[string]int{"a": 0, "b": -1},
+			nodes:     []string{"a", "b", "c"},
+			want:      "c",
+		},
+		{
+			name:      "weighted random all zero",
+			scheduler: SchedulerWeightedRandom,
+			weights:   map[string]int{"a": 0, "b": 0},
+			nodes:     []string{"a", "b"},
+			want:      "",
+		},
+		{
+			name:      "least in flight by capacity",
+			scheduler: SchedulerLeastInFlight,
+			nodes:     nodes,
+			stats: NodeStats{
+				InFlight: map[string]int{"a": 1, "b": 2, "c": 2},
+				Capacity: map[string]int{"a": 1, "b": 4, "c": 2},
+			},
+			want: "b",
+		},
+		{
+			name:      "least in flight missing capacity",
+			scheduler: SchedulerLeastInFlight,
+			nodes:     []string{"a", "b"},
+			stats:     NodeStats{InFlight: map[string]int{"a": 1}},
+			want:      "b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheduler, err := NewScheduler(tt.scheduler, tt.weights)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := scheduler.Pick(tt.nodes, tt.stats); got != tt.want {
+				t.Fatalf("Pick() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundRobinRotates(t *testing.T) {
+	scheduler, _ := NewScheduler(SchedulerRoundRobin, nil)
+	nodes := []string{"a", "b", "c"}
+	for i, want := range []string{"a", "b", "c", "a", "b"} {
+		if got := scheduler.Pick(nodes, NodeStats{}); got != want {
+			t.Fatalf("pick %d = %q, want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"farshore.ai/fast-comfy-api/config"
+	"farshore.ai/fast-comfy-api/model"
+)
+
+/*
+
+远程 URL 输入
+
+image_url / audio_url / video_url 类型的变量传入 http(s) 地址，网关在入队前下载到内存，
+校验大小与文件类型后按文件类型变量处理（选定节点后上传到节点 input 目录）
+
+为防止 SSRF，所有连接（包括重定向）在建立前检查解析出的 IP：
+回环、私有、链路本地、组播等地址一律拒绝，除非主机名在 allow_hosts 中或 IP 在 allow_cidrs 中
+校验与拨号使用同一次 DNS 解析的结果，避免 DNS rebinding
+任务回调（callback_url）同样由调用方提供地址，WebhookDispatcher 使用同一套地址检查（newClient）
+*/
+
+// blockedNets net.IP 方法未覆盖的保留网段
+var blockedNets = mustParseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4")
+
+// ErrAddressBlocked 目标地址为内网或保留地址
+var ErrAddressBlocked = errors.New("address is not allowed")
+
+// URLFetcher 下载远程输入文件
+type URLFetcher struct {
+	client     *http.Client
+	allowHosts map[string]struct{}
+	allowNets  []*net.IPNet
+}
+
+func NewURLFetcher(cfg model.InputFetchConfig) *URLFetcher {
+	fetcher := &URLFetcher{
+		allowHosts: make(map[string]struct{}, len(cfg.AllowHosts)),
+	}
+	for _, host := range cfg.AllowHosts {
+		fetcher.allowHosts[strings.ToLower(host)] = struct{}{}
+	}
+	for _, cidr := range cfg.AllowCIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			LogAPIRuntime(ColorRed+"[URLFetcher] allow_cidrs 格式错误，已忽略: %s", cidr)
+			continue
+		}
+		fetcher.allowNets = append(fetcher.allowNets, ipnet)
+	}
+	fetcher.client = fetcher.newClient(config.InputFetchTimeout * time.Second)
+	return fetcher
+}
+
+// newClient 创建连接前检查目标地址的 HTTP 客户端
+func (f *URLFetcher) newClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: nil, // 不走环境变量代理，否则地址检查只作用于代理本身
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				ip, port, err := f.resolve(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+				return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			},
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme: %s", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// CheckURL 校验 http(s) 地址并检查解析出的 IP 是否允许连接（提前拒绝，实际连接时仍会再次检查）
+func (f *URLFetcher) CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url: %s", rawURL)
+	}
+	port := u.Port()
+	switch {
+	case port != "":
+	case u.Scheme == "https":
+		port = "443"
+	default:
+		port = "80"
+	}
+	_, _, err = f.resolve(ctx, net.JoinHostPort(u.Hostname(), port))
+	return err
+}
+
+// resolve 解析地址并检查是否允许连接，返回用于拨号的 IP
+func (f *URLFetcher) resolve(ctx context.Context, addr string) (net.IP, string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, "", err
+	}
+	_, hostAllowed := f.allowHosts[strings.ToLower(host)]
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, addr := range addrs {
+		if hostAllowed || f.ipAllowed(addr.IP) {
+			return addr.IP, port, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%w: %s", ErrAddressBlocked, host)
+}
+
+// ipAllowed 公网地址，或在 allow_cidrs 中
+func (f *URLFetcher) ipAllowed(ip net.IP) bool {
+	for _, ipnet := range f.allowNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, ipnet := range blockedNets {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fetch 下载 rawURL，media 为期望的媒体类型（image / audio / video），maxSize 单位 MB
+func (f *URLFetcher) Fetch(ctx context.Context, rawURL string, media string, maxSize int) (InputFile, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return InputFile{}, fmt.Errorf("invalid url: %s", rawURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return InputFile{}, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return InputFile{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return InputFile{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	limit := int64(maxSize) << 20
+	if resp.ContentLength > limit {
+		return InputFile{}, fmt.Errorf("文件超过 %d MB", maxSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return InputFile{}, err
+	}
+	if int64(len(data)) > limit {
+		return InputFile{}, fmt.Errorf("文件超过 %d MB", maxSize)
+	}
+
+	// 文件名取 URL 路径（最终地址，跟随重定向后），没有扩展名时按识别出的类型补上，节点加载器依赖扩展名
+	filename := path.Base(resp.Request.URL.Path)
+	contentType := detectDataContentType(filename, data)
+	if filepath.Ext(filename) == "" {
+		filename += fileExtension(contentType)
+	}
+	file := InputFile{Filename: filename, ContentType: contentType, Data: data}
+	if err := checkInputFile(file, media, maxSize); err != nil {
+		return InputFile{}, err
+	}
+	return file, nil
+}
+
+// 辅助函数：解析固定的 CIDR 列表
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"farshore.ai/fast-comfy-api/model"
+)
+
+func TestURLFetcherIPAllowed(t *testing.T) {
+	fetcher := NewURLFetcher(model.InputFetchConfig{AllowCIDRs: []string{"10.1.0.0/16", "bad-cidr"}})
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"198.18.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.1.2.3", true}, // allow_cidrs 放行
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := fetcher.ipAllowed(net.ParseIP(tt.ip)); got != tt.want {
+				t.Fatalf("ipAllowed(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestURLFetcherCheckURL(t *testing.T) {
+	fetcher := NewURLFetcher(model.InputFetchConfig{AllowHosts: []string{"127.0.0.2"}})
+	tests := []struct {
+		url     string
+		blocked bool
+		invalid bool
+	}{
+		{url: "http://127.0.0.1/a.png", blocked: true},
+		{url: "https://127.0.0.1:8443/a.png", blocked: true},
+		{url: "http://[::1]/a.png", blocked: true},
+		{url: "http://10.0.0.1/a.png", blocked: true},
+		{url: "http://169.254.169.254/latest/meta-data", blocked: true},
+		{url: "http://127.0.0.2/a.png"}, // allow_hosts 放行
+		{url: "http://8.8.8.8/a.png"},
+		{url: "ftp://8.8.8.8/a.png", invalid: true},
+		{url: "file:///etc/passwd", invalid: true},
+		{url: "http:///a.png", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := fetcher.CheckURL(context.Background(), tt.url)
+			switch {
+			case tt.blocked:
+				if !errors.Is(err, ErrAddressBlocked) {
+					t.Fatalf("CheckURL() error = %v, want ErrAddressBlocked", err)
+				}
+			case tt.invalid:
+				if err == nil || errors.Is(err, ErrAddressBlocked) {
+					t.Fatalf("CheckURL() error = %v, want invalid url", err)
+				}
+			case err != nil:
+				t.Fatalf("CheckURL() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestURLFetcherFetchLoopback(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x02\x00\x00\x00")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(png)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		cfg     model.InputFetchConfig
+		blocked bool
+	}{
+		{name: "loopback blocked", blocked: true},
+		{name: "loopback allowed by cidr", cfg: model.InputFetchConfig{AllowCIDRs: []string{"127.0.0.0/8"}}},
+		{name: "loopback allowed by host", cfg: model.InputFetchConfig{AllowHosts: []string{"127.0.0.1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := NewURLFetcher(tt.cfg).Fetch(context.Background(), server.URL+"/input", "image", 1)
+			if tt.blocked {
+				if !errors.Is(err, ErrAddressBlocked) {
+					t.Fatalf("Fetch() error = %v, want ErrAddressBlocked", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			if file.ContentType != "image/png" || file.Filename != "input.png" {
+				t.Fatalf("Fetch() = %s (%s), want input.png (image/png)", file.Filename, file.ContentType)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"farshore.ai/fast-comfy-api/config"
+	"farshore.ai/fast-comfy-api/model"
+)
+
+/*
+
+任务完成回调（Webhook）
+
+任务进入终态后向调用方提供的 callback_url POST 结果：
+- X-Fast-Comfy-Timestamp: 发送时间戳（秒）
+- X-Fast-Comfy-Signature: sha256=HMAC_SHA256(callback_secret, timestamp + "." + body) 的 hex
+- 非 2xx 响应或请求失败时按指数退避重试，每次投递都会记录到投递日志
+- 回调地址由调用方提供，连接前与 URL 输入相同检查目标 IP（input_fetch.allow_hosts / allow_cidrs 放行内网地址）
+- API 未配置 callback_secret 时不接受 callback_url，接收方无法校验未签名的回调
+*/
+
+const (
+	WebhookTimestampHeader = "X-Fast-Comfy-Timestamp"
+	WebhookSignatureHeader = "X-Fast-Comfy-Signature"
+)
+
+// WebhookPayload 回调内容
+type WebhookPayload struct {
+	JobID    string             `json:"job_id"`
+	APIName  string             `json:"api_name"`
+	PromptID string             `json:"prompt_id"`
+	Node     string             `json:"node"`
+	Tried    []string           `json:"nodes_tried,omitempty"` // 已尝试过的节点
+	State    JobState           `json:"state"`
+	URLs     []string           `json:"urls"`
+	Outputs  []model.NodeOutput `json:"outputs,omitempty"` // 按输出节点分组
+	Error    string             `json:"error,omitempty"`
+	Detail   *ExecutionError    `json:"error_detail,omitempty"` // ComfyUI 执行失败详情
+}
+
+// WebhookDelivery 一次投递记录
+type WebhookDelivery struct {
+	JobID      string    `json:"job_id"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// WebhookDispatcher 负责签名、投递、重试以及记录投递日志
+type WebhookDispatcher struct {
+	client     *http.Client
+	mu         sync.RWMutex
+	deliveries []WebhookDelivery // 最近的投递记录，最多保留 config.WebhookLogSize 条
+}
+
+// NewWebhookDispatcher fetcher 提供地址检查，回调与 URL 输入共用 allow_hosts / allow_cidrs
+func NewWebhookDispatcher(fetcher *URLFetcher) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		client: fetcher.newClient(config.WebhookTimeout * time.Second),
+	}
+}
+
+// Dispatch 异步投递回调，失败按 2s、4s、8s... 退避重试
+func (d *WebhookDispatcher) Dispatch(callbackURL, secret string, payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		LogAPIRuntime(ColorRed+"[Webhook] 序列化回调内容失败: %s", err)
+		return
+	}
+
+	go func() {
+		backoff := config.WebhookBaseBackoff * time.Second
+		for attempt := 1; attempt <= config.WebhookMaxAttempts; attempt++ {
+			status, err := d.send(callbackURL, secret, body)
+			delivery := WebhookDelivery{
+				JobID:      payload.JobID,
+				URL:        callbackURL,
+				Attempt:    attempt,
+				StatusCode: status,
+				Success:    err == nil,
+				Time:       time.Now(),
+			}
+			if err != nil {
+				delivery.Error = err.Error()
+			}
+			d.record(delivery)
+
+			if err == nil {
+				LogAPIRuntime(ColorGreen+"[Webhook] 回调成功 job_id=%s url=%s", payload.JobID, callbackURL)
+				return
+			}
+			LogAPIRuntime(ColorYellow+"[Webhook] 回调失败(第 %d 次) job_id=%s url=%s err=%s", attempt, payload.JobID, callbackURL, err)
+			if attempt < config.WebhookMaxAttempts {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+	}()
+}
+
+// send 发送一次回调，返回状态码
+func (d *WebhookDispatcher) send(callbackURL, secret string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if secret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(secret, timestamp, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("callback returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// SignWebhook 计算回调签名，调用方可用同样的算法校验
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// record 记录投递日志，超出上限时丢弃最旧的记录
+func (d *WebhookDispatcher) record(delivery WebhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deliveries = append(d.deliveries, delivery)
+	if len(d.deliveries) > config.WebhookLogSize {
+		d.deliveries = d.deliveries[len(d.deliveries)-config.WebhookLogSize:]
+	}
+}
+
+// Deliveries 查询投递日志，jobID 为空时返回全部
+func (d *WebhookDispatcher) Deliveries(jobID string) []WebhookDelivery {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	list := []WebhookDelivery{}
+	for _, delivery := range d.deliveries {
+		if jobID == "" || delivery.JobID == jobID {
+			list = append(list, delivery)
+		}
+	}
+	return list
+}
@@ -1,8 +1,15 @@
 package handler
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"farshore.ai/fast-comfy-api/core"
@@ -34,6 +41,14 @@ func Fail(msg string) Response {
 	}
 }
 
+func FailWithData(msg string, data interface{}) Response {
+	return Response{
+		Code: -1,
+		Msg:  msg,
+		Data: data,
+	}
+}
+
 // =======================
 // 💡 APIHandler 主体
 // =======================
@@ -42,24 +57,112 @@ type APIHandler struct {
 }
 
 // 创建实例
-func NewAPIHandler(resourceDir string, s3Config model.S3Config, checkInterval time.Duration, enabled bool) *APIHandler {
+func NewAPIHandler(resourceDir string, cfg *model.Config) *APIHandler {
 	return &APIHandler{
-		APIManager: core.NewAPIManager(resourceDir, s3Config, checkInterval, enabled),
+		APIManager: core.NewAPIManager(resourceDir, cfg),
+	}
+}
+
+// =======================
+// 📨 生成请求参数
+// =======================
+type GenerateRequest struct {
+	Token       string                 `json:"token"`
+	Vars        map[string]interface{} `json:"vars"`
+	CallbackURL string                 `json:"callback_url"` // 可选，任务结束后回调
+	Priority    int                    `json:"priority"`     // 可选，排队优先级，越大越先执行
+
+	Files map[string]core.InputFile `json:"-"` // multipart 上传的文件类型变量，字段名为变量名
+}
+
+// IdempotencyKeyHeader 客户端重试时携带相同的值，避免重复提交
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+func (req GenerateRequest) toCore(c *gin.Context) core.GenerateRequest {
+	return core.GenerateRequest{
+		Token:          req.Token,
+		Vars:           req.Vars,
+		CallbackURL:    req.CallbackURL,
+		Priority:       req.Priority,
+		Files:          req.Files,
+		IdempotencyKey: c.GetHeader(IdempotencyKeyHeader),
+	}
+}
+
+// bindGenerateRequest 支持 JSON 请求体，或 multipart 表单（携带文件类型变量）
+func bindGenerateRequest(c *gin.Context, req *GenerateRequest) error {
+	if c.ContentType() == "multipart/form-data" {
+		return parseGenerateForm(c, req)
+	}
+	if err := c.ShouldBindJSON(req); err != nil {
+		return errors.New("invalid request body")
+	}
+	return nil
+}
+
+// parseGenerateForm 解析 multipart 表单：token、vars（JSON 字符串）、callback_url、priority，
+// 其余文件字段按变量名作为文件类型变量
+func parseGenerateForm(c *gin.Context, req *GenerateRequest) error {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return fmt.Errorf("invalid multipart form: %w", err)
+	}
+	req.Token = c.PostForm("token")
+	req.CallbackURL = c.PostForm("callback_url")
+	if vars := c.PostForm("vars"); vars != "" {
+		if err := json.Unmarshal([]byte(vars), &req.Vars); err != nil {
+			return fmt.Errorf("invalid vars: %s", err)
+		}
+	}
+	if priority := c.PostForm("priority"); priority != "" {
+		n, err := strconv.Atoi(priority)
+		if err != nil {
+			return fmt.Errorf("invalid priority: %s", priority)
+		}
+		req.Priority = n
+	}
+
+	req.Files = make(map[string]core.InputFile, len(form.File))
+	for name, headers := range form.File {
+		if len(headers) != 1 {
+			return fmt.Errorf("variable %s expects exactly one file", name)
+		}
+		file, err := headers[0].Open()
+		if err != nil {
+			return fmt.Errorf("failed to open file %s: %w", name, err)
+		}
+		input, err := core.NewInputFile(headers[0].Filename, file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("invalid file %s: %w", name, err)
+		}
+		req.Files[name] = input
 	}
+	return nil
+}
+
+// =======================
+// 📦 同步生成结果
+// =======================
+// GenerateResponse data 保持为全部文件地址（兼容旧调用方），任务信息放在同级字段
+type GenerateResponse struct {
+	Response
+	JobID      string             `json:"job_id"`
+	PromptID   string             `json:"prompt_id"`
+	Node       string             `json:"node"`
+	NodesTried []string           `json:"nodes_tried"` // 已尝试过的节点，发生故障转移时有多个
+	Outputs    []model.NodeOutput `json:"outputs"`
 }
 
 // =======================
 // 🚀 生成任务接口
 // =======================
 func (h *APIHandler) GenerateSyncHandler(c *gin.Context) {
-	var req struct {
-		Token string                 `json:"token"`
-		Vars  map[string]interface{} `json:"vars"`
-	}
+	var req GenerateRequest
 
 	// 参数解析
-	if err := c.ShouldBindJSON(&req); err != nil {
-		h.JSON(c, http.StatusBadRequest, Fail("invalid request body"))
+	if err := bindGenerateRequest(c, &req); err != nil {
+		h.JSON(c, http.StatusBadRequest, Fail(err.Error()))
 		return
 	}
 
@@ -70,14 +173,260 @@ func (h *APIHandler) GenerateSyncHandler(c *gin.Context) {
 	}
 
 	// 调用核心逻辑
-	urls, err := h.APIManager.GenerateSync(req.Token, req.Vars)
+	job, err := h.APIManager.GenerateSync(c.Request.Context(), req.toCore(c))
 	if err != nil {
+		if h.overloaded(c, err) || h.idempotencyMismatch(c, err) {
+			return
+		}
+		// ComfyUI 执行失败时返回失败节点、异常信息以及 traceback
+		var execErr *core.ExecutionError
+		if errors.As(err, &execErr) {
+			h.JSON(c, http.StatusInternalServerError, FailWithData(err.Error(), execErr))
+			return
+		}
 		h.JSON(c, http.StatusInternalServerError, Fail(err.Error()))
 		return
 	}
 
-	// 成功响应
-	h.JSON(c, http.StatusOK, Success(urls))
+	// 成功响应，data 为全部文件地址，outputs 按输出节点分组
+	urls := job.URLs
+	if urls == nil {
+		urls = []string{}
+	}
+	c.JSON(http.StatusOK, GenerateResponse{
+		Response:   Success(urls),
+		JobID:      job.ID,
+		PromptID:   job.PromptID,
+		Node:       job.Node,
+		NodesTried: job.Tried,
+		Outputs:    job.Outputs,
+	})
+}
+
+// =======================
+// 🕒 异步生成任务接口
+// =======================
+func (h *APIHandler) GenerateAsyncHandler(c *gin.Context) {
+	var req GenerateRequest
+
+	// 参数解析
+	if err := bindGenerateRequest(c, &req); err != nil {
+		h.JSON(c, http.StatusBadRequest, Fail(err.Error()))
+		return
+	}
+
+	// 校验 token
+	if req.Token == "" {
+		h.JSON(c, http.StatusBadRequest, Fail("missing token"))
+		return
+	}
+
+	// 任务进入网关队列后立即返回 job_id
+	job, err := h.APIManager.GenerateAsync(req.toCore(c))
+	if err != nil {
+		if h.overloaded(c, err) || h.idempotencyMismatch(c, err) {
+			return
+		}
+		h.JSON(c, http.StatusInternalServerError, Fail(err.Error()))
+		return
+	}
+
+	h.JSON(c, http.StatusOK, Success(job))
+}
+
+// =======================
+// 📚 批量生成接口
+// =======================
+type BatchGenerateRequest struct {
+	Token       string                   `json:"token"`
+	Items       []map[string]interface{} `json:"items"`       // 每一条的替换变量
+	Concurrency int                      `json:"concurrency"` // 可选，默认等于节点数
+	Priority    int                      `json:"priority"`    // 可选，排队优先级，作用于所有条目
+}
+
+// BatchGenerateResult 批量生成结果，items 与输入顺序一致
+type BatchGenerateResult struct {
+	Total     int                    `json:"total"`
+	Succeeded int                    `json:"succeeded"`
+	Failed    int                    `json:"failed"`
+	Items     []core.BatchItemResult `json:"items"`
+}
+
+// GenerateBatchHandler 支持 JSON 请求体，或 multipart 上传 JSONL 文件（每行一组变量）
+func (h *APIHandler) GenerateBatchHandler(c *gin.Context) {
+	var req BatchGenerateRequest
+
+	// 参数解析
+	if c.ContentType() == "multipart/form-data" {
+		if err := parseBatchForm(c, &req); err != nil {
+			h.JSON(c, http.StatusBadRequest, Fail(err.Error()))
+			return
+		}
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		h.JSON(c, http.StatusBadRequest, Fail("invalid request body"))
+		return
+	}
+
+	// 校验 token
+	if req.Token == "" {
+		h.JSON(c, http.StatusBadRequest, Fail("missing token"))
+		return
+	}
+	if len(req.Items) == 0 {
+		h.JSON(c, http.StatusBadRequest, Fail("missing items"))
+		return
+	}
+
+	// 调用核心逻辑，单条失败记录在对应条目中
+	items, err := h.APIManager.GenerateBatch(c.Request.Context(), core.BatchRequest{
+		Token:       req.Token,
+		Items:       req.Items,
+		Concurrency: req.Concurrency,
+		Priority:    req.Priority,
+	})
+	if err != nil && items == nil {
+		h.JSON(c, http.StatusBadRequest, Fail(err.Error()))
+		return
+	}
+
+	result := BatchGenerateResult{Total: len(items), Items: items}
+	for _, item := range items {
+		if item.State == core.JobSucceeded {
+			result.Succeeded++
+		} else {
+			result.Failed++
+		}
+	}
+	h.JSON(c, http.StatusOK, Success(result))
+}
+
+// parseBatchForm 解析 multipart 表单：token、concurrency、priority 以及 JSONL 文件 file
+func parseBatchForm(c *gin.Context, req *BatchGenerateRequest) error {
+	req.Token = c.PostForm("token")
+	if concurrency := c.PostForm("concurrency"); concurrency != "" {
+		n, err := strconv.Atoi(concurrency)
+		if err != nil {
+			return fmt.Errorf("invalid concurrency: %s", concurrency)
+		}
+		req.Concurrency = n
+	}
+	if priority := c.PostForm("priority"); priority != "" {
+		n, err := strconv.Atoi(priority)
+		if err != nil {
+			return fmt.Errorf("invalid priority: %s", priority)
+		}
+		req.Priority = n
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return fmt.Errorf("missing file")
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var vars map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &vars); err != nil {
+			return fmt.Errorf("invalid jsonl at line %d: %s", line, err)
+		}
+		req.Items = append(req.Items, vars)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	return nil
+}
+
+// =======================
+// 🔍 查询任务状态接口
+// =======================
+func (h *APIHandler) GetJobHandler(c *gin.Context) {
+	id := c.Param("id")
+	job, ok := h.APIManager.GetJob(id)
+	if !ok {
+		h.JSON(c, http.StatusNotFound, Fail(fmt.Sprintf("job %s not found", id)))
+		return
+	}
+	h.JSON(c, http.StatusOK, Success(job))
+}
+
+// =======================
+// 🛑 取消任务接口
+// =======================
+func (h *APIHandler) CancelJobHandler(c *gin.Context) {
+	job, err := h.APIManager.CancelJob(c.Param("id"))
+	if err != nil {
+		status := http.StatusBadRequest
+		if job.ID == "" {
+			status = http.StatusNotFound
+		}
+		h.JSON(c, status, Fail(err.Error()))
+		return
+	}
+	h.JSON(c, http.StatusOK, Success(job))
+}
+
+// =======================
+// 📶 任务进度事件流（SSE）
+// =======================
+func (h *APIHandler) JobEventsHandler(c *gin.Context) {
+	id := c.Param("id")
+	events, done, cancel, ok := h.APIManager.SubscribeJob(id)
+	if !ok {
+		h.JSON(c, http.StatusNotFound, Fail(fmt.Sprintf("job %s not found", id)))
+		return
+	}
+	defer cancel()
+
+	// 先推送一次当前状态
+	job, _ := h.APIManager.GetJob(id)
+	id = job.ID
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent(core.EventJobState, core.NewJobStateEvent(job))
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event := <-events:
+			c.SSEvent(event.Type, event)
+			return true
+		case <-done:
+			// 任务结束，推送最终状态后关闭连接
+			job, _ := h.APIManager.GetJob(id)
+			c.SSEvent(core.EventJobState, core.NewJobStateEvent(job))
+			return false
+		case <-heartbeat.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		}
+	})
+}
+
+// =======================
+// 📮 回调投递日志接口
+// =======================
+func (h *APIHandler) ListWebhookDeliveriesHandler(c *gin.Context) {
+	list := h.APIManager.ListWebhookDeliveries(c.Query("job_id"))
+	h.JSON(c, http.StatusOK, Success(list))
 }
 
 // ====================
@@ -88,6 +437,43 @@ func (h *APIHandler) ListAPIsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, Success(list))
 }
 
+// ====================
+// 🖥️ 节点状态接口
+// ======================
+func (h *APIHandler) ListNodesHandler(c *gin.Context) {
+	h.JSON(c, http.StatusOK, Success(h.APIManager.ListNodes()))
+}
+
+func (h *APIHandler) GetNodeHandler(c *gin.Context) {
+	name := c.Param("name")
+	node, ok := h.APIManager.GetNode(name)
+	if !ok {
+		h.JSON(c, http.StatusNotFound, Fail(fmt.Sprintf("node %s not found", name)))
+		return
+	}
+	h.JSON(c, http.StatusOK, Success(node))
+}
+
+// DrainNodeHandler 排空节点：不再分配新任务，已提交的任务正常完成
+func (h *APIHandler) DrainNodeHandler(c *gin.Context) {
+	h.setNodeDrained(c, true)
+}
+
+// UndrainNodeHandler 取消排空，节点恢复分配任务
+func (h *APIHandler) UndrainNodeHandler(c *gin.Context) {
+	h.setNodeDrained(c, false)
+}
+
+func (h *APIHandler) setNodeDrained(c *gin.Context, drained bool) {
+	name := c.Param("name")
+	node, ok := h.APIManager.DrainNode(name, drained)
+	if !ok {
+		h.JSON(c, http.StatusNotFound, Fail(fmt.Sprintf("node %s not found", name)))
+		return
+	}
+	h.JSON(c, http.StatusOK, Success(node))
+}
+
 // =========================
 // ⏱️ 启动 指定 API 服务
 // ========================
@@ -124,6 +510,26 @@ func (h *APIHandler) StopAPIHandler(c *gin.Context) {
 // =======================
 // 🧩 封装统一响应输出
 // =======================
+// overloaded API 过载时返回 429 并通过 Retry-After 告知重试间隔（秒）
+func (h *APIHandler) overloaded(c *gin.Context, err error) bool {
+	var overload *core.OverloadError
+	if !errors.As(err, &overload) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(overload.RetryAfter.Seconds()))))
+	h.JSON(c, http.StatusTooManyRequests, Fail(err.Error()))
+	return true
+}
+
+// idempotencyMismatch 重用的 Idempotency-Key 对应的请求内容不同，返回 422
+func (h *APIHandler) idempotencyMismatch(c *gin.Context, err error) bool {
+	if !errors.Is(err, core.ErrIdempotencyMismatch) {
+		return false
+	}
+	h.JSON(c, http.StatusUnprocessableEntity, Fail(err.Error()))
+	return true
+}
+
 func (h *APIHandler) JSON(c *gin.Context, status int, resp Response) {
 	c.JSON(status, resp)
 }
@@ -3,8 +3,6 @@ package main
 import (
 	"fmt"
 
-	"time"
-
 	"farshore.ai/fast-comfy-api/config"
 	"farshore.ai/fast-comfy-api/handler"
 	"farshore.ai/fast-comfy-api/routes"
@@ -20,7 +18,6 @@ func main() {
 		panic(err)
 	}
 	// 3️⃣ 读取配置
-	s3config := config.S3
 	serverconfig := config.Server
 	port := serverconfig.Port
 
@@ -34,8 +31,7 @@ func main() {
 	}
 
 	// ✅ 创建 handler（内部自动加载并启动所有 API）
-	checkInterval := time.Duration(config.HotReload.Interval) * time.Second
-	h := handler.NewAPIHandler("./resource/apis", s3config, checkInterval, config.HotReload.Enabled)
+	h := handler.NewAPIHandler("./resource/apis", config)
 
 	// 设置路由
 	r := gin.Default()
@@ -15,16 +15,41 @@ type NodeMeta struct {
 // Variable 定义一个可替换的变量（带类型、默认值、路径）
 type Variable struct {
 	Path    string      `json:"path"`    // 变量对应 prompt 中的路径，如 "757.inputs.wildcard_text"
-	Type    string      `json:"type"`    // 变量类型，例如 "string"、"number"、"bool" 等
+	Type    string      `json:"type"`    // 变量类型，例如 "string"、"number"、"bool"，文件类型为 "image"、"mask"、"image_url" 等
 	Default interface{} `json:"default"` // 默认值
+
+	Original string `json:"original"` // mask 类型变量对应的 image 变量名，mask 不填 path 时写入该变量的 path
 }
 
 // API 是主结构体，描述一个完整的 API 配置
 type API struct {
-	Name         string                `json:"name"`          // API 名称
-	Description  string                `json:"description"`   // API 描述
-	Prompt       map[string]PromptNode `json:"prompt"`        // 节点 ID -> 节点结构
-	ComfyuiNodes []string              `json:"comfyui_nodes"` // ComfyUI 节点服务器列表
-	Variables    map[string]Variable   `json:"variables"`     // 可替换变量定义
-	Token        string                `json:"token"`         // API Token
+	Name           string                `json:"name"`             // API 名称
+	Description    string                `json:"description"`      // API 描述
+	Prompt         map[string]PromptNode `json:"prompt"`           // 节点 ID -> 节点结构
+	ComfyuiNodes   []string              `json:"comfyui_nodes"`    // ComfyUI 节点服务器列表
+	Variables      map[string]Variable   `json:"variables"`        // 可替换变量定义
+	Token          string                `json:"token"`            // API Token
+	Timeout        int                   `json:"timeout"`          // 任务等待超时（秒），不填默认 60
+	CallbackSecret string                `json:"callback_secret"`  // 任务完成回调的签名密钥
+	Scheduler      string                `json:"scheduler"`        // 节点调度策略：least_queue（默认）、round_robin、weighted_random、least_in_flight
+	NodeWeights    map[string]int        `json:"node_weights"`     // weighted_random 策略的节点权重，未配置的节点权重为 1
+	Retry          RetryPolicy           `json:"retry"`            // 节点故障时的重试策略
+	MinFreeVRAM    int64                 `json:"min_free_vram_mb"` // 节点最少空闲显存（MB），不满足的节点不参与调度，并优先空闲显存多的节点
+	Affinity       AffinityConfig        `json:"affinity"`         // 模型亲和调度配置
+	MaxQueueSize   int                   `json:"max_queue_size"`   // 网关队列长度上限，超过时拒绝请求（429），不填默认 100
+	MaxConcurrent  int                   `json:"max_concurrent"`   // 本 API 同时提交到节点（未结束）的任务数上限，不填不限制
+	MaxQueueWait   int                   `json:"max_queue_wait"`   // 请求在网关队列中最长等待时间（秒），超过时拒绝（429），不填不限制
+	MaxBase64Size  int                   `json:"max_base64_size"`  // vars 中 data URI / base64 文件解码后的大小上限（MB），不填按变量类型的默认上限
+}
+
+// AffinityConfig 模型亲和调度配置
+type AffinityConfig struct {
+	// MaxQueueGap 已加载相同模型的节点负载比调度策略选中的节点最多高出多少时仍优先选择它
+	// 不填为 0（负载相同时优先热节点），-1 表示关闭模型亲和
+	MaxQueueGap *int `json:"max_queue_gap"`
+}
+
+// RetryPolicy 节点拒绝提交或任务执行中节点失联时，将同一个 prompt（相同 seed）重新提交到其他健康节点
+type RetryPolicy struct {
+	MaxAttempts int `json:"max_attempts"` // 最多尝试的节点数（包含首次提交），不填或 <=1 表示不重试
 }
@@ -28,10 +28,44 @@ type FeishuConfig struct {
 	WebHook string `yaml:"webhook"` // 飞书 WebHook 地址
 }
 
+// JobStoreConfig 定义任务日志配置
+type JobStoreConfig struct {
+	Dir string `yaml:"dir"` // 任务日志目录，为空时不落盘
+}
+
+// InputFetchConfig 定义 URL 类型变量的下载配置
+type InputFetchConfig struct {
+	AllowHosts []string `yaml:"allow_hosts"` // 允许访问的内网主机名，如内网 MinIO
+	AllowCIDRs []string `yaml:"allow_cidrs"` // 允许访问的内网网段，如 10.0.0.0/8
+}
+
+// NodeConfig 定义一个 ComfyUI 节点
+type NodeConfig struct {
+	Name     string   `yaml:"name"`     // 节点名称，API 配置中通过名称引用
+	URL      string   `yaml:"url"`      // 节点地址，如 http://127.0.0.1:8188
+	Labels   []string `yaml:"labels"`   // 节点标签，API 配置中可通过标签引用一组节点
+	Capacity int      `yaml:"capacity"` // 节点同时执行的任务数，不填使用 comfyui.default_capacity
+}
+
+// ComfyUIConfig 定义全局 ComfyUI 节点配置
+type ComfyUIConfig struct {
+	ClientID string       `yaml:"client_id"` // 共享 WebSocket 连接与提交 prompt 使用的 clientId
+	Nodes    []NodeConfig `yaml:"nodes"`     // 节点列表
+
+	DefaultCapacity int `yaml:"default_capacity"` // 未填 capacity 的节点与 API 配置中直接填写地址的节点的容量，不填默认 1
+
+	MaxVRAMPercent float64 `yaml:"max_vram_percent"` // 显存使用率超过该值的节点暂不接收新任务（请求在网关排队），不填或 0 表示不限制
+	MaxGPUTemp     int     `yaml:"max_gpu_temp"`     // GPU 温度超过该值的节点暂不接收新任务（请求在网关排队），不填或 0 表示不限制
+}
+
 // Config 整体配置
 type Config struct {
 	S3        S3Config        `yaml:"s3"`
 	Server    ServerConfig    `yaml:"server"`
 	HotReload HotReloadConfig `yaml:"hot_reload"`
 	Feishu    FeishuConfig    `yaml:"feishu"`
+	JobStore  JobStoreConfig  `yaml:"job_store"`
+	ComfyUI   ComfyUIConfig   `yaml:"comfyui"`
+
+	InputFetch InputFetchConfig `yaml:"input_fetch"` // URL 输入下载与任务回调的地址检查
 }
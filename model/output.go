@@ -3,4 +3,21 @@ package model
 type Address struct {
 	Subfolder string `json:"subfolder"`
 	Filename  string `json:"filename"`
+	Type      string `json:"type"` // output / temp / input
+}
+
+// NodeOutput 单个输出节点的生成结果
+type NodeOutput struct {
+	NodeID string   `json:"node_id"` // 节点 ID
+	Title  string   `json:"title"`   // 节点标题（_meta.title）
+	URLs   []string `json:"urls"`    // 文件地址
+}
+
+// FlattenURLs 将按节点分组的结果展开为地址列表
+func FlattenURLs(outputs []NodeOutput) []string {
+	urls := []string{}
+	for _, output := range outputs {
+		urls = append(urls, output.URLs...)
+	}
+	return urls
 }
@@ -9,9 +9,19 @@ func RegisterAPIRoutes(r *gin.Engine, h *handler.APIHandler) {
 	api := r.Group("/api")
 	{
 		api.POST("/generate_sync", h.GenerateSyncHandler)
+		api.POST("/generate_async", h.GenerateAsyncHandler)
+		api.POST("/generate_batch", h.GenerateBatchHandler)
+		api.GET("/jobs/:id", h.GetJobHandler)
+		api.GET("/jobs/:id/events", h.JobEventsHandler)
+		api.POST("/jobs/:id/cancel", h.CancelJobHandler)
+		api.GET("/webhooks/deliveries", h.ListWebhookDeliveriesHandler)
 
 		// ✅ 管理接口
 		api.GET("/list", h.ListAPIsHandler)
+		api.GET("/nodes", h.ListNodesHandler)
+		api.GET("/nodes/:name", h.GetNodeHandler)
+		api.POST("/nodes/:name/drain", h.DrainNodeHandler)
+		api.POST("/nodes/:name/undrain", h.UndrainNodeHandler)
 		api.POST("/start/:token", h.StartAPIHandler)
 		api.POST("/stop/:token", h.StopAPIHandler)
 	}